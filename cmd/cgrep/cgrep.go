@@ -16,18 +16,55 @@ import (
 	"github.com/junkblocker/codesearch/regexp"
 )
 
-var usageMessage = `usage: cgrep [-c] [-h] [-i] [-l [-0]] [-n] regexp [file...]
+var usageMessage = `usage: cgrep [-A num] [-B num] [-C num] [-c] [-color when] [-column] [-F] [-h] [-i] [-json] [-l [-0]] [-L] [-n] [-o] [-S] [-v] [-w] [-x] regexp [file...]
+       cgrep [options] -e regexp [-e regexp...] [file...]
+       cgrep [options] -patterns FILE [file...]
 
 cgrep behaves like grep, searching for regexp, an RE2 (nearly PCRE) regular expression.
 
 Options:
+  -A NUM       print NUM lines of context after each matching line
+  -B NUM       print NUM lines of context before each matching line
+  -C NUM       print NUM lines of context before and after each matching
+               line, unless overridden by -A or -B
   -c           print only a count of selected lines to stdout
+  -color WHEN  highlight file names, line numbers and matches: WHEN is
+               auto (the default: only if stdout is a terminal), always
+               or never; colors are read from $GREP_COLORS as described
+               by csearch -help
+  -column      print the 1-based byte column of the first match in each
+               matching line, after the line number
+  -e REGEXP    search for REGEXP; may be repeated to search for lines
+               matching any of several regexps
+  -F           search for fixed strings instead of regexps
   -h           print this help text and exit
   -i           case-insensitive grep
+  -json        print results as JSON Lines, in the format described
+               by csearch -help
   -l           print only the names of the files containing matches
-  -0           print -l matches separated by NUL ('\0') character
+  -L           print only the names of the files containing no matches
+  -0           print -l or -L matches separated by NUL ('\0') character
   -n           print each output line preceded by its relative line number in
                the file, starting at 1
+  -o           print only the matched parts of matching lines, each on its
+               own line (with -column, preceded by its own column)
+  -patterns FILE
+               search for the regexps in FILE, one per line, as well as
+               those given with -e
+  -S           smart case: ignore case in each regexp without upper-case
+               letters; on by default if $CSEARCHSMARTCASE is 1 or true,
+               as described by csearch -help
+  -showpattern print the number of the first regexp matching each line,
+               counting from 1 in the order given by -e and -patterns,
+               after the line number and column
+  -v           select the lines that do not match instead of those that do
+  -w           select only lines where the match is a whole word, starting
+               and ending at word boundaries (\b)
+  -x           select only lines matched as a whole
+
+With -A, -B or -C, context lines are marked with '-' instead of ':' after
+the file name and line number, and non-adjacent groups of lines are
+separated by a line containing '--'.
 
 Note that as per Go's flag parsing convention, the options cannot be combined.
 For example, the option pair -i -n cannot be abbreviated to -in.
@@ -53,8 +90,9 @@ func main() {
 	g.Stderr = os.Stderr
 	flag.Usage = usage
 	flag.Parse()
-	args := flag.Args()
-	if len(args) == 0 {
+	exprs, args, err := g.Exprs(flag.Args())
+	if err != nil {
+		log.Print(err)
 		flag.Usage()
 	}
 
@@ -68,19 +106,15 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	pat := "(?m)" + args[0]
-	if *iflag {
-		pat = "(?i)" + pat
-	}
-	re, err := regexp.Compile(pat)
+	re, err := g.Compile(exprs, *iflag)
 	if err != nil {
 		log.Fatal(err)
 	}
 	g.Regexp = re
-	if len(args) == 1 {
+	if len(args) == 0 {
 		g.Reader(os.Stdin, "<standard input>")
 	} else {
-		for _, arg := range args[1:] {
+		for _, arg := range args {
 			g.File(arg)
 		}
 	}
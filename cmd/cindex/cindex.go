@@ -13,18 +13,23 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/junkblocker/codesearch/index"
 )
 
 const (
+	DEFAULT_WORKERS                     = 4
 	DEFAULT_MAX_FILE_LENGTH             = 1 << 30
 	DEFAULT_MAX_LINE_LENGTH             = 2000
 	DEFAULT_MAX_TEXT_TRIGRAMS           = 30000
 	DEFAULT_MAX_INVALID_UTF8_PERCENTAGE = 0.1
+	DEFAULT_WATCH_DELAY                 = 2 * time.Second
+	DEFAULT_WATCH_INTERVAL              = 30 * time.Second
 )
 
 var usageMessage = `usage: cindex [options] [path...]
@@ -34,11 +39,27 @@ Options:
   -verbose     print extra information
   -list        list indexed paths and exit
   -reset       discard existing index
+  -remove      remove the named paths, and every file under them, from the
+               index instead of adding them
+  -full        reread every file, even those unchanged since they were
+               last indexed
   -indexpath FILE
                use specified FILE as the index path. Overrides $CSEARCHINDEX.
+  -shards      use a sharded index: the index path names a directory of
+               shards, created if needed (Default: whether it already is one)
+  -format VERSION
+               write the index in format VERSION: 1 (limited to 4 GB) or 2
+               (Default: the format of the existing index, or 1)
   -cpuprofile FILE
                write CPU profile to FILE
+  -workers N   read N files at once (Default: %d); each reader needs
+               64 MB of memory for its trigram table, and up to 64 MB more
+               for the trigrams of a large file
   -logskip     print why a file was skipped from indexing
+  -skipreport FILE
+               write a JSON Lines record for each skipped file to FILE
+  -gitignore   skip files and directories ignored by .gitignore or .ignore
+               files, and .git directories
   -no-follow-symlinks
                do not follow symlinked files and directories
   -maxFileLen BYTES
@@ -49,8 +70,17 @@ Options:
                skip indexing a file if it has more than this number of trigrams (Default: %v)
   -maxinvalidutf8ratio RATIO
                skip indexing a file if it has more than this ratio of invalid UTF-8 sequences (Default: %v)
+  -watch       after indexing, keep running and update the index whenever
+               files under the indexed paths change (Linux only)
+  -watchdelay DURATION
+               wait until changes have stopped for DURATION before updating
+               the index in -watch mode (Default: %v)
+  -watchinterval DURATION
+               update the index at most once per DURATION in -watch mode
+               (Default: %v)
   -exclude FILE
-               path to file containing a list of file patterns to exclude from indexing
+               path to file containing a list of rules for files to exclude
+               from indexing
   -filelist FILE
                path to file containing a list of file paths to index
 
@@ -75,28 +105,124 @@ If cindex is invoked with no paths, it reindexes the paths that have
 already been added, in case the files have changed.  Thus, 'cindex' by
 itself is a useful command to run in a nightly cron job.
 
+To convert an existing index to another format, run cindex with no paths
+and the -format flag.  For example, to lift the 4 GB limit on the index:
+
+	cindex -format 2
+
+In a format 2 index, files whose size, modification time and inode have
+not changed since they were last indexed are carried over from the
+existing index without being read again.  Format 1 indexes, which older
+versions of cindex and csearch can read, do not record what the files
+looked like, so every file is reread.  The -full flag causes cindex to
+reread the unchanged files anyway, which is useful after changing the
+limits on what gets indexed.
+
 By default cindex adds the named paths to the index but preserves
 information about other paths that might already be indexed
 (the ones printed by cindex -list).  The -reset flag causes cindex to
 delete the existing index before indexing the new paths.
 With no path arguments, cindex -reset removes the index.
+
+The -shards flag causes cindex to keep the index as a directory of
+shards, each an index of some of the paths, listed in a manifest file.
+cindex then indexes each path in the shard already covering it, or else
+in a new shard, and updates only the shards of the paths it is given,
+one at a time: the others are left as they are.  With no paths, it
+updates every shard.  Once an index directory has a manifest, cindex
+treats it as sharded without the flag, and csearch searches all its
+shards in parallel.  -watch does not work with sharded indexes.
+
+The -watch flag causes cindex to keep running after it has updated the
+index.  It watches the indexed paths for changes and folds the changed
+files into the index, in batches.  A batch is merged once no changes have
+been seen for the -watchdelay duration, but no sooner than -watchinterval
+after the previous merge.  Symbolic links to directories are not watched.
+
+The -gitignore flag causes cindex to skip the files and directories that
+git would ignore according to the .gitignore files in the indexed trees,
+and also those matched by .ignore files, which use the same syntax and
+take precedence over .gitignore.  Ignore files in the directories above
+an indexed path apply as well, up to the root of the enclosing git
+repository; outside a repository, only those in the indexed tree do.
+With -logskip, cindex reports the ignore file, line and rule that
+excluded each skipped path.  The global git excludes file and
+.git/info/exclude are not consulted.
+
+The -exclude flag names a file of rules, one per line, for files and
+directories to leave out of the index.  Blank lines and lines starting
+with # are ignored.  A rule is a glob pattern, or a regular expression
+following the prefix "regexp:".  A glob containing no / is matched
+against the base name of every path, so *.o excludes object files at any
+depth.  Other globs, and regular expressions, are matched against the
+path relative to the indexed path it lies under, using / as separator.
+In globs, ** matches any number of directories, so third_party/**/testdata
+excludes every testdata directory under third_party, and web/**/*.min.js
+excludes minified scripts only under web.  A trailing / makes a glob
+match directories only.  A leading ! turns a rule into an include rule
+that brings back paths excluded by earlier rules; when several rules
+match a path, the last one decides.  Paths inside an excluded directory
+cannot be brought back, since the directory is not read at all.
+For example:
+
+	# build output, except the generated protocol buffers
+	build/
+	*.pb.go
+	!gen/**/*.pb.go
+	regexp:(^|/)[^/]*_test\.go$
+
+After indexing, cindex logs how many files were skipped for each reason.
+The -skipreport flag causes cindex to also write a JSON object for each
+skipped file or directory to the named file, one per line.  Each object
+has the fields "path" and "reason", and, depending on the reason, "value"
+for the measured value, "limit" for the limit it exceeded, and "detail"
+for an error message or ignore rule.  The reasons are:
+
+	too-long             file longer than -maxfilelen bytes
+	long-line            line longer than -maxlinelen bytes; value is
+	                     the length read before giving up
+	too-many-trigrams    more than -maxtrigrams distinct trigrams
+	invalid-utf8         ratio of invalid UTF-8 above -maxinvalidutf8ratio
+	binary               contains a NUL byte; value is its offset
+	excluded             matched by an -exclude rule
+	ignored              matched by a -gitignore rule
+	symlink              symbolic link, with -no-follow-symlinks
+	symlink-unresolved   symbolic link that could not be resolved
+	unsupported-type     not a regular file, directory or symbolic link
+	stat-error           could not be examined
+	error                could not be read
+
+The -remove flag causes cindex to drop the named paths from the index
+without reindexing anything else.  Removing a directory that lies inside
+an indexed path only drops the files currently indexed under it; they
+come back the next time the enclosing path is reindexed.
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage, DEFAULT_MAX_FILE_LENGTH, DEFAULT_MAX_LINE_LENGTH, DEFAULT_MAX_TEXT_TRIGRAMS, DEFAULT_MAX_INVALID_UTF8_PERCENTAGE)
+	fmt.Fprintf(os.Stderr, usageMessage, DEFAULT_WORKERS, DEFAULT_MAX_FILE_LENGTH, DEFAULT_MAX_LINE_LENGTH, DEFAULT_MAX_TEXT_TRIGRAMS, DEFAULT_MAX_INVALID_UTF8_PERCENTAGE, DEFAULT_WATCH_DELAY, DEFAULT_WATCH_INTERVAL)
 	os.Exit(2)
 }
 
 var (
 	listFlag             = flag.Bool("list", false, "list indexed paths and exit")
 	resetFlag            = flag.Bool("reset", false, "discard existing index")
+	removeFlag           = flag.Bool("remove", false, "remove paths from the index")
+	fullFlag             = flag.Bool("full", false, "reread every file, even those unchanged since they were last indexed")
 	verboseFlag          = flag.Bool("verbose", false, "print extra information")
 	cpuProfile           = flag.String("cpuprofile", "", "write cpu profile to this file")
+	workersFlag          = flag.Int("workers", DEFAULT_WORKERS, "read this many files at once")
 	indexPath            = flag.String("indexpath", "", "specifies index path")
+	formatFlag           = flag.Int("format", 0, "index format version to write")
 	logSkipFlag          = flag.Bool("logskip", false, "print why a file was skipped from indexing")
+	skipReport           = flag.String("skipreport", "", "write a JSON Lines record for each skipped file to this file")
+	gitignoreFlag        = flag.Bool("gitignore", false, "skip files ignored by .gitignore or .ignore files")
 	noFollowSymlinksFlag = flag.Bool("no-follow-symlinks", false, "do not follow symlinked files and directories")
-	exclude              = flag.String("exclude", "", "path to file containing a list of file patterns to exclude from indexing")
+	exclude              = flag.String("exclude", "", "path to file containing a list of rules for files to exclude from indexing")
 	fileList             = flag.String("filelist", "", "path to file containing a list of file paths to index")
+	shardsFlag           = flag.Bool("shards", false, "use a sharded index, in the directory given as the index path")
+	watchFlag            = flag.Bool("watch", false, "keep the index up to date as files change")
+	watchDelay           = flag.Duration("watchdelay", DEFAULT_WATCH_DELAY, "wait until changes have stopped for this long before updating the index")
+	watchInterval        = flag.Duration("watchinterval", DEFAULT_WATCH_INTERVAL, "update the index at most this often")
 	// Tuning variables for detecting text files.
 	// A file is assumed not to be text files (and thus not indexed) if
 	// 1) if it contains an invalid UTF-8 sequences
@@ -108,54 +234,64 @@ var (
 	maxLineLen          = flag.Int("maxlinelen", DEFAULT_MAX_LINE_LENGTH, "skip indexing a file if it has a line longer than this size in bytes")
 	maxTextTrigrams     = flag.Int("maxtrigrams", DEFAULT_MAX_TEXT_TRIGRAMS, "skip indexing a file if it has more than this number of trigrams")
 	maxInvalidUTF8Ratio = flag.Float64("maxinvalidutf8ratio", DEFAULT_MAX_INVALID_UTF8_PERCENTAGE, "skip indexing a file if it has more than this ratio of invalid UTF-8 sequences")
-
-	excludePatterns = []string{
-		".csearchindex",
-	}
 )
 
-func walk(arg string, symlinkFrom string, out chan string, logskip bool) {
+// walk sends the files in the tree rooted at arg to out.  If arg was
+// reached through the symlink symlinkFrom, the files are reported under
+// that name instead.  Exclude rules are matched relative to root, the
+// indexed path that the walk started from.  Skipped paths are recorded
+// in the skip report and, if logskip is set, logged.
+func walk(root, arg string, symlinkFrom string, out chan string, logskip bool) {
 	filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+		name := path
+		if symlinkFrom != "" {
+			name = symlinkFrom + path[len(arg):]
+		}
 		if basedir, elem := filepath.Split(path); elem != "" {
-			exclude := false
-			for _, pattern := range excludePatterns {
-				exclude, err = filepath.Match(pattern, elem)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if exclude {
-					break
-				}
+			exclude := excluded(root, name, info != nil && info.IsDir())
+			top := root
+			if symlinkFrom != "" {
+				// path is in the tree the symlink points to.
+				top = arg
 			}
 
 			// Skip various temporary or "hidden" files or directories.
 			if info != nil && info.IsDir() {
 				if exclude {
 					if logskip {
-						if symlinkFrom != "" {
-							log.Printf("%s: skipped. Excluded directory", symlinkFrom+path[len(arg):])
-						} else {
-							log.Printf("%s: skipped. Excluded directory", path)
-						}
+						log.Printf("%s: skipped. Excluded directory", name)
+					}
+					skipped(name, skipExcluded, "")
+					return filepath.SkipDir
+				}
+				if rule := ignoredBy(top, path, true); rule != nil {
+					if logskip {
+						log.Printf("%s: skipped. Ignored by %s", name, rule)
 					}
+					skipped(name, skipIgnored, rule.String())
 					return filepath.SkipDir
 				}
 			} else {
 				if exclude {
 					if logskip {
-						if symlinkFrom != "" {
-							log.Printf("%s: skipped. Excluded file", symlinkFrom+path[len(arg):])
-						} else {
-							log.Printf("%s: skipped. Excluded file", path)
-						}
+						log.Printf("%s: skipped. Excluded file", name)
+					}
+					skipped(name, skipExcluded, "")
+					return nil
+				}
+				if rule := ignoredBy(top, path, false); rule != nil {
+					if logskip {
+						log.Printf("%s: skipped. Ignored by %s", name, rule)
 					}
+					skipped(name, skipIgnored, rule.String())
 					return nil
 				}
 				if info != nil && info.Mode()&os.ModeSymlink != 0 {
 					if *noFollowSymlinksFlag {
 						if logskip {
-							log.Printf("%s: skipped. Symlink", path)
+							log.Printf("%s: skipped. Symlink", name)
 						}
+						skipped(name, skipSymlink, "")
 						return nil
 					}
 					var symlinkAs string
@@ -168,55 +304,58 @@ func walk(arg string, symlinkFrom string, out chan string, logskip bool) {
 						symlinkAs = symlinkFrom + symlinkAs[len(arg):]
 					}
 					if p, err := filepath.EvalSymlinks(symlinkAs); err != nil {
-						if symlinkFrom != "" {
-							log.Printf("%s: skipped. Symlink could not be resolved", symlinkFrom+path[len(arg):])
-						} else {
-							log.Printf("%s: skipped. Symlink could not be resolved", path)
-						}
+						log.Printf("%s: skipped. Symlink could not be resolved", name)
+						skipped(name, skipSymlinkUnresolved, err.Error())
 					} else {
-						walk(p, symlinkAs, out, logskip)
+						walk(root, p, symlinkAs, out, logskip)
 					}
 					return nil
 				}
 			}
 		}
 		if err != nil {
-			if symlinkFrom != "" {
-				log.Printf("%s: skipped. Error: %s", symlinkFrom+path[len(arg):], err)
-			} else {
-				log.Printf("%s: skipped. Error: %s", path, err)
-			}
+			log.Printf("%s: skipped. Error: %s", name, err)
+			skipped(name, index.SkipError, err.Error())
 			return nil
 		}
 		if info != nil {
 			if info.Mode()&os.ModeType == 0 {
-				if symlinkFrom == "" {
-					out <- path
-				} else {
-					out <- symlinkFrom + path[len(arg):]
-				}
+				out <- name
 			} else if !info.IsDir() {
 				if logskip {
-					if symlinkFrom != "" {
-						log.Printf("%s: skipped. Unsupported path type", symlinkFrom+path[len(arg):])
-					} else {
-						log.Printf("%s: skipped. Unsupported path type", path)
-					}
+					log.Printf("%s: skipped. Unsupported path type", name)
 				}
+				skipped(name, skipUnsupported, "")
 			}
 		} else {
 			if logskip {
-				if symlinkFrom != "" {
-					log.Printf("%s: skipped. Could not stat.", symlinkFrom+path[len(arg):])
-				} else {
-					log.Printf("%s: skipped. Could not stat.", path)
-				}
+				log.Printf("%s: skipped. Could not stat.", name)
 			}
+			skipped(name, skipStat, "")
 		}
 		return nil
 	})
 }
 
+// unchanged reports whether the file at path is recorded in the old index
+// with the same size, modification time and inode that it has now.
+// If so, it also returns the file's ID in the old index.
+func unchanged(old *index.Index, path string) (uint32, bool) {
+	if old == nil {
+		return 0, false
+	}
+	id, ok := old.Lookup(path)
+	if !ok {
+		return 0, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	info := old.FileInfo(id)
+	return id, info != (index.FileInfo{}) && info == index.NewFileInfo(fi)
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
@@ -227,7 +366,18 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	if files := index.Files(); len(files) > 1 {
+		log.Fatalf("cindex updates a single index, not %s", strings.Join(files, ", "))
+	}
+	sharded := *shardsFlag || index.IsSharded(index.File())
+	if sharded && *watchFlag {
+		log.Fatal("-watch does not support sharded indexes")
+	}
 
+	if *listFlag && sharded {
+		listShards(index.File())
+		return
+	}
 	if *listFlag {
 		master := index.File()
 		if stat, err := os.Stat(master); err != nil || stat == nil {
@@ -252,6 +402,10 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *resetFlag && len(args) == 0 && sharded {
+		resetShards(index.File())
+		return
+	}
 	if *resetFlag && len(args) == 0 {
 		master := index.File()
 		stat, err := os.Stat(master)
@@ -266,6 +420,34 @@ func main() {
 		log.Fatal("Invalid index path " + master)
 	}
 
+	if *removeFlag {
+		if len(args) == 0 || *resetFlag {
+			usage()
+		}
+		master := index.File()
+		if stat, err := os.Stat(master); err != nil || stat == nil {
+			log.Fatal("Index " + master + " is not accessible")
+		} else if !sharded && (stat.IsDir() || !stat.Mode().IsRegular()) {
+			log.Fatal("Index " + master + " must point to an index file")
+		}
+		for i, arg := range args {
+			a, err := filepath.Abs(arg)
+			if err != nil {
+				log.Fatalf("%s: %s", arg, err)
+			}
+			args[i] = a
+		}
+		if sharded {
+			removeShards(master, args)
+			return
+		}
+		log.Printf("remove %s", strings.Join(args, " "))
+		index.Remove(master+"~", master, args)
+		replaceIndex(master, master+"~")
+		log.Printf("done")
+		return
+	}
+
 	if *exclude != "" {
 		var excludePath string
 		if (*exclude)[:2] == "~/" {
@@ -280,10 +462,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		excludePatterns = append(excludePatterns, strings.Split(string(data), "\n")...)
-		for i, pattern := range excludePatterns {
-			excludePatterns[i] = strings.TrimSpace(pattern)
+		rules, err := parseExcludeRules(string(data))
+		if err != nil {
+			log.Fatalf("%s: %s", excludePath, err)
 		}
+		excludeRules = append(excludeRules, rules...)
 	}
 
 	if *fileList != "" {
@@ -303,7 +486,7 @@ func main() {
 		args = append(args, strings.Split(string(data), "\n")...)
 	}
 
-	if len(args) == 0 {
+	if len(args) == 0 && !sharded {
 		ix := index.Open(index.File())
 		for _, arg := range ix.Paths() {
 			args = append(args, arg)
@@ -328,10 +511,32 @@ func main() {
 		args = args[1:]
 	}
 
+	if *skipReport != "" {
+		openSkipReport(*skipReport)
+	}
 	master := index.File()
+	if sharded {
+		updateShards(master, args)
+	} else {
+		update(master, args)
+	}
+	flushSkipReport()
+	log.Printf("done")
+
+	if *watchFlag {
+		// The skip report stays open for the updates watch makes.
+		watch(master)
+	}
+	closeSkipReport()
+}
+
+// update indexes the paths in the index file master,
+// creating it if it does not exist.
+func update(master string, args []string) {
+	reset := *resetFlag
 	if stat, err := os.Stat(master); err != nil {
 		// Does not exist.
-		*resetFlag = true
+		reset = true
 	} else {
 		if stat != nil && (stat.IsDir() || !stat.Mode().IsRegular()) {
 			log.Fatal("Invalid index path " + master)
@@ -339,18 +544,69 @@ func main() {
 
 	}
 	file := master
-	if !*resetFlag {
+	if !reset {
 		file += "~"
 	}
 
+	var old *index.Index
+	if !reset {
+		old = index.Open(master)
+	}
+	version := *formatFlag
+	switch {
+	case version == 0 && old != nil:
+		version = old.Version()
+	case version == 0:
+		version = 1
+	case version != 1 && version != 2:
+		log.Fatalf("unknown index format %d", version)
+	}
+	if *fullFlag && old != nil {
+		old.Close()
+		old = nil
+	}
+
+	ix := newWriter(file, version)
+	ix.AddPaths(args)
+	keep := indexPaths(ix, old, args, args)
+	log.Printf("flush index")
+	ix.Flush()
+	ix.Close()
+	logSkipSummary()
+
+	if old != nil {
+		log.Printf("reusing %d unchanged files", len(keep))
+		old.Close()
+	}
+
+	if !reset {
+		mergeIndex(master, file, keep, *formatFlag)
+	}
+}
+
+// newWriter returns an IndexWriter writing the given format version
+// to file, configured according to the command-line flags.
+func newWriter(file string, version int) *index.IndexWriter {
 	ix := index.Create(file)
+	ix.Version = version
 	ix.Verbose = *verboseFlag
 	ix.LogSkip = *logSkipFlag
 	ix.MaxFileLen = *maxFileLen
 	ix.MaxLineLen = *maxLineLen
 	ix.MaxTextTrigrams = *maxTextTrigrams
 	ix.MaxInvalidUTF8Ratio = *maxInvalidUTF8Ratio
-	ix.AddPaths(args)
+	ix.Workers = *workersFlag
+	ix.OnSkip = indexSkipped
+	return ix
+}
+
+// indexPaths adds the files in the trees rooted at paths to ix.
+// Each path lies in the indexed tree rooted at the corresponding entry
+// of roots, against which the exclude rules are matched.
+// Files that are unchanged since they were indexed in old, which may be
+// nil, are not reread; indexPaths returns their sorted IDs in old instead.
+func indexPaths(ix *index.IndexWriter, old *index.Index, roots, paths []string) []uint32 {
+	var keep []uint32 // IDs of unchanged files in old
 
 	walkChan := make(chan string)
 	doneChan := make(chan bool)
@@ -362,6 +618,13 @@ func main() {
 			case path := <-walkChan:
 				if !seen[path] {
 					seen[path] = true
+					if id, ok := unchanged(old, path); ok {
+						if *verboseFlag {
+							log.Printf("%s: unchanged", path)
+						}
+						keep = append(keep, id)
+						continue
+					}
 					ix.AddFile(path)
 				}
 			case <-doneChan:
@@ -369,23 +632,39 @@ func main() {
 			}
 		}
 	}()
-	for _, arg := range args {
-		log.Printf("index %s", arg)
-		walk(arg, "", walkChan, *logSkipFlag)
+	for i, path := range paths {
+		log.Printf("index %s", path)
+		walk(roots[i], path, "", walkChan, *logSkipFlag)
 	}
 	doneChan <- true
-	log.Printf("flush index")
-	ix.Flush()
+	sort.Sort(uint32Slice(keep))
+	return keep
+}
+
+// mergeIndex merges the index in file into master, keeping the files
+// of master listed in keep, and then replaces master with the result,
+// written in the given format version, or in the newer of theirs if 0.
+func mergeIndex(master, file string, keep []uint32, version int) {
+	log.Printf("merge %s %s", master, file)
+	index.UpdateVersion(file+"~", master, file, keep, version)
+	os.Remove(file)
+	replaceIndex(master, file+"~")
+}
 
-	if !*resetFlag {
-		log.Printf("merge %s %s", master, file)
-		index.Merge(file+"~", master, file)
-		os.Remove(file)
+// replaceIndex renames file to master.  Where possible, the rename is
+// atomic, so that concurrent searches see either the old or the new index.
+func replaceIndex(master, file string) {
+	if runtime.GOOS == "windows" {
+		// Windows cannot rename onto an existing file.
 		os.Remove(master)
-		if err := os.Rename(file+"~", master); err != nil {
-			log.Fatalf("failed to merge indexes: %s", err)
-		}
 	}
-	log.Printf("done")
-	return
+	if err := os.Rename(file, master); err != nil {
+		log.Fatalf("failed to replace index: %s", err)
+	}
 }
+
+type uint32Slice []uint32
+
+func (x uint32Slice) Len() int           { return len(x) }
+func (x uint32Slice) Less(i, j int) bool { return x[i] < x[j] }
+func (x uint32Slice) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
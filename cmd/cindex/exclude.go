@@ -0,0 +1,115 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/junkblocker/codesearch/glob"
+)
+
+// An excludeRule is a single rule from the -exclude file.
+type excludeRule struct {
+	line    int            // line number in the exclude file, 0 if built in
+	text    string         // rule as written
+	include bool           // rule starts with !: include matching paths
+	dirOnly bool           // rule ends with /: match directories only
+	base    bool           // pattern has no /: match the base name at any depth
+	pattern string         // glob pattern, if re is nil
+	re      *regexp.Regexp // regular expression, for regexp: rules
+}
+
+// excludeRules are the rules applied by excluded, in order.
+// Later rules take precedence over earlier ones.
+var excludeRules = []*excludeRule{
+	{text: ".csearchindex", base: true, pattern: ".csearchindex"},
+}
+
+// match reports whether the rule matches the slash-separated path rel,
+// relative to the root of the indexed tree.
+func (r *excludeRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.re != nil {
+		return r.re.MatchString(rel)
+	}
+	if r.base {
+		rel = path.Base(rel)
+	}
+	ok, _ := glob.Match(r.pattern, rel)
+	return ok
+}
+
+// excluded reports whether the file or directory at path, in the tree
+// rooted at root, is excluded by the exclude rules.
+// The root itself is matched by its base name.
+func excluded(root, path string, isDir bool) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		rel = filepath.Base(path)
+	}
+	rel = filepath.ToSlash(rel)
+	exclude := false
+	for _, r := range excludeRules {
+		if r.match(rel, isDir) {
+			exclude = !r.include
+		}
+	}
+	return exclude
+}
+
+// parseExcludeRules parses the contents of an exclude file.
+// Each line holds one rule; blank lines and lines starting with #
+// are ignored.  A rule is a glob pattern, or a regular expression
+// following the prefix "regexp:".  A leading ! turns the rule into
+// an include rule, and a trailing / restricts a glob to directories.
+// A glob containing no / matches the base name of a path at any depth;
+// any other glob, and every regular expression, matches the slash-separated
+// path relative to the root of the indexed tree.
+func parseExcludeRules(data string) ([]*excludeRule, error) {
+	var rules []*excludeRule
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r := &excludeRule{line: n + 1, text: line}
+		p := line
+		switch {
+		case p[0] == '!':
+			r.include = true
+			p = p[1:]
+		case strings.HasPrefix(p, "\\!"), strings.HasPrefix(p, "\\#"):
+			p = p[1:]
+		}
+		if strings.HasPrefix(p, "regexp:") {
+			re, err := regexp.Compile(p[len("regexp:"):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", r.line, err)
+			}
+			r.re = re
+			rules = append(rules, r)
+			continue
+		}
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		r.base = !strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" || !glob.Valid(p) {
+			return nil, fmt.Errorf("line %d: invalid pattern %q", r.line, line)
+		}
+		r.pattern = p
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var parseExcludeTests = []struct {
+	data  string
+	lines []int // line numbers of the rules parsed
+	err   string
+}{
+	{"", nil, ""},
+	{"\n  \n# comment\n\t# indented comment\n", nil, ""},
+	{"a\n\n# b\nc/\n", []int{1, 4}, ""},
+	{"  *.o  \n!keep.o\n\\!bang\n\\#hash\n", []int{1, 2, 3, 4}, ""},
+	{"regexp:^a/\nregexp:b$\n", []int{1, 2}, ""},
+	{"a\nregexp:(\n", nil, "line 2: "},
+	{"a\n[\n", nil, `line 2: invalid pattern "["`},
+	{"/\n", nil, `line 1: invalid pattern "/"`},
+	{"!\n", nil, `line 1: invalid pattern "!"`},
+}
+
+func TestParseExcludeRules(t *testing.T) {
+	for _, tt := range parseExcludeTests {
+		rules, err := parseExcludeRules(tt.data)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("parseExcludeRules(%q) error = %v, want %q...", tt.data, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseExcludeRules(%q): %v", tt.data, err)
+			continue
+		}
+		var lines []int
+		for _, r := range rules {
+			lines = append(lines, r.line)
+		}
+		if len(lines) != len(tt.lines) {
+			t.Errorf("parseExcludeRules(%q) lines = %v, want %v", tt.data, lines, tt.lines)
+			continue
+		}
+		for i := range lines {
+			if lines[i] != tt.lines[i] {
+				t.Errorf("parseExcludeRules(%q) lines = %v, want %v", tt.data, lines, tt.lines)
+				break
+			}
+		}
+	}
+}
+
+var excludedTests = []struct {
+	rules string
+	path  string // under the root /r
+	isDir bool
+	want  bool
+}{
+	// The built-in rule.
+	{"", "/r/.csearchindex", false, true},
+	{"", "/r/a/b/.csearchindex", false, true},
+	{"", "/r/a/b/x.csearchindex", false, false},
+	{"!.csearchindex", "/r/a/.csearchindex", false, false},
+
+	// Base name globs match at any depth; others from the root.
+	{"*.o", "/r/x.o", false, true},
+	{"*.o", "/r/a/b/x.o", false, true},
+	{"*.o", "/r/a/b/x.go", false, false},
+	{"a/*.o", "/r/a/x.o", false, true},
+	{"a/*.o", "/r/b/a/x.o", false, false},
+	{"/x.o", "/r/x.o", false, true},
+	{"/x.o", "/r/a/x.o", false, false},
+	{"*", "/r", true, true},
+
+	// **.
+	{"a/**/x.o", "/r/a/x.o", false, true},
+	{"a/**/x.o", "/r/a/b/c/x.o", false, true},
+	{"a/**/x.o", "/r/b/x.o", false, false},
+	{"a/**", "/r/a/b", true, true},
+	{"**/build", "/r/build", true, true},
+	{"**/build", "/r/a/b/build", true, true},
+
+	// Directory-only rules.
+	{"build/", "/r/a/build", true, true},
+	{"build/", "/r/a/build", false, false},
+
+	// Comments and blank lines are not rules.
+	{"# x.o\n\n", "/r/x.o", false, false},
+	{"\\#x.o", "/r/#x.o", false, true},
+	{"\\!x.o", "/r/!x.o", false, true},
+
+	// The last matching rule decides.
+	{"*.o\n!keep.o", "/r/keep.o", false, false},
+	{"*.o\n!keep.o", "/r/drop.o", false, true},
+	{"!keep.o\n*.o", "/r/keep.o", false, true},
+	{"*.o\n!keep.o\nkeep.o", "/r/keep.o", false, true},
+	{"!x.o", "/r/x.o", false, false},
+
+	// Regular expressions match the path from the root, unanchored.
+	{"regexp:\\.o$", "/r/a/x.o", false, true},
+	{"regexp:^a/", "/r/a/x", false, true},
+	{"regexp:^a/", "/r/b/a/x", false, false},
+	{"regexp:^a/\n!regexp:^a/keep", "/r/a/keep", false, false},
+	{"regexp:^a/\n!regexp:^a/keep", "/r/a/drop", false, true},
+}
+
+func TestExcluded(t *testing.T) {
+	defer func(rules []*excludeRule) { excludeRules = rules }(excludeRules)
+	builtin := excludeRules
+	for _, tt := range excludedTests {
+		rules, err := parseExcludeRules(tt.rules)
+		if err != nil {
+			t.Errorf("parseExcludeRules(%q): %v", tt.rules, err)
+			continue
+		}
+		excludeRules = append(builtin[:len(builtin):len(builtin)], rules...)
+		if got := excluded("/r", tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excluded(%q, %v) with rules %q = %v, want %v", tt.path, tt.isDir, tt.rules, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/junkblocker/codesearch/glob"
+)
+
+// ignoreFiles are the names of the files read by -gitignore, in the order
+// their rules are applied. Later rules take precedence over earlier ones,
+// so .ignore can override .gitignore in the same directory.
+var ignoreFiles = []string{".gitignore", ".ignore"}
+
+// An ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	file    string // ignore file the rule came from
+	line    int    // line number in file
+	text    string // rule as written
+	pattern string // glob pattern
+	negate  bool   // rule starts with !: re-include matching paths
+	dirOnly bool   // rule ends with /: match directories only
+	base    bool   // pattern has no /: match the base name at any depth
+}
+
+func (r *ignoreRule) String() string {
+	if r.file == "" {
+		return "built-in rule " + r.text
+	}
+	return fmt.Sprintf("%s:%d: %s", r.file, r.line, r.text)
+}
+
+// gitDirRule is reported for the .git directories skipped by -gitignore.
+var gitDirRule = &ignoreRule{text: ".git/"}
+
+// match reports whether the rule matches the slash-separated path rel,
+// relative to the directory holding the rule's ignore file.
+func (r *ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base {
+		rel = path.Base(rel)
+	}
+	ok, _ := glob.Match(r.pattern, rel)
+	return ok
+}
+
+// An ignoreDir holds the rules read from the ignore files in dir.
+type ignoreDir struct {
+	dir   string
+	rules []*ignoreRule
+}
+
+// An ignoreKey identifies the ignore rules that apply to the entries
+// of dir, in a tree whose rules are read from top down.
+type ignoreKey struct {
+	top, dir string
+}
+
+// ignoreChains caches, for each directory, the ignore rules that apply
+// to its entries: those of the directory itself and of its ancestors, up to
+// the top directory, outermost first.  ignoreTops caches the top directory
+// for each indexed root: the root of the git repository enclosing it, or
+// else the root itself.
+var (
+	ignoreMu     sync.Mutex
+	ignoreChains = make(map[ignoreKey][]*ignoreDir)
+	ignoreTops   = make(map[string]string)
+)
+
+// isIgnoreFile reports whether name is the base name of an ignore file.
+func isIgnoreFile(name string) bool {
+	for _, f := range ignoreFiles {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetIgnoreRules discards the cached ignore rules,
+// so that they are reread when next needed.
+func forgetIgnoreRules() {
+	ignoreMu.Lock()
+	ignoreChains = make(map[ignoreKey][]*ignoreDir)
+	ignoreTops = make(map[string]string)
+	ignoreMu.Unlock()
+}
+
+// ignoredBy returns the ignore rule excluding the file or directory at path,
+// in the tree rooted at root, or nil if -gitignore is off or the path is not
+// ignored.  The ignore files above root apply only if root is inside a git
+// repository, up to the root of the repository.
+func ignoredBy(root, path string, isDir bool) *ignoreRule {
+	if !*gitignoreFlag {
+		return nil
+	}
+	if isDir && filepath.Base(path) == ".git" {
+		return gitDirRule
+	}
+	ignoreMu.Lock()
+	defer ignoreMu.Unlock()
+	var found *ignoreRule
+	for _, d := range ignoreChain(ignoreTop(root), filepath.Dir(path)) {
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, r := range d.rules {
+			if r.match(rel, isDir) {
+				found = r
+			}
+		}
+	}
+	if found == nil || found.negate {
+		return nil
+	}
+	return found
+}
+
+// ignoreTop returns the top directory whose ignore files apply to the tree
+// rooted at root: the root of the enclosing git repository, or else root,
+// or the directory holding root if it is a file.  ignoreMu must be held.
+func ignoreTop(root string) string {
+	if top, ok := ignoreTops[root]; ok {
+		return top
+	}
+	top := root
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		top = filepath.Dir(root)
+	}
+	for dir := top; ; {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			top = dir
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	ignoreTops[root] = top
+	return top
+}
+
+// ignoreChain returns the cached ignore rules for entries of dir,
+// reading them if needed, from the directories from top down to dir.
+// ignoreMu must be held.
+func ignoreChain(top, dir string) []*ignoreDir {
+	key := ignoreKey{top, dir}
+	if chain, ok := ignoreChains[key]; ok {
+		return chain
+	}
+	var chain []*ignoreDir
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err != nil && dir != top {
+		// Not the root of a repository; inherit the parent's rules.
+		if parent := filepath.Dir(dir); parent != dir {
+			chain = ignoreChain(top, parent)
+		}
+	}
+	d := readIgnoreDir(dir)
+	if len(d.rules) > 0 {
+		chain = append(chain[:len(chain):len(chain)], d)
+	}
+	ignoreChains[key] = chain
+	return chain
+}
+
+// readIgnoreDir reads the ignore files in dir.
+func readIgnoreDir(dir string) *ignoreDir {
+	d := &ignoreDir{dir: dir}
+	for _, name := range ignoreFiles {
+		file := filepath.Join(dir, name)
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			if r := parseIgnoreRule(s.Text()); r != nil {
+				r.file = file
+				r.line = n
+				d.rules = append(d.rules, r)
+			}
+		}
+		if err := s.Err(); err != nil {
+			log.Printf("%s: %s", file, err)
+		}
+		f.Close()
+	}
+	return d
+}
+
+// parseIgnoreRule parses a line of an ignore file, following the rules
+// of gitignore(5). It returns nil for blank lines, comments and
+// malformed patterns.
+func parseIgnoreRule(line string) *ignoreRule {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped with a backslash.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	r := &ignoreRule{text: line}
+	p := line
+	switch {
+	case p[0] == '!':
+		r.negate = true
+		p = p[1:]
+	case strings.HasPrefix(p, "\\!"), strings.HasPrefix(p, "\\#"):
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if !strings.Contains(p, "/") {
+		r.base = true
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == "" || !glob.Valid(p) {
+		return nil
+	}
+	r.pattern = p
+	return r
+}
@@ -0,0 +1,160 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var parseIgnoreTests = []struct {
+	line string
+	rule string // pattern and flags, or "" for no rule
+}{
+	{"", ""},
+	{"   ", ""},
+	{"# comment", ""},
+	{"*.o", "*.o base"},
+	{"*.o  ", "*.o base"},
+	{"a\\ ", "a\\  base"},
+	{"*.o\r", "*.o base"},
+	{"!keep.o", "keep.o negate base"},
+	{"\\!bang", "!bang base"},
+	{"\\#hash", "#hash base"},
+	{"/top", "top"},
+	{"build/", "build dirOnly base"},
+	{"/build/", "build dirOnly"},
+	{"a/b", "a/b"},
+	{"a/**/b", "a/**/b"},
+	{"**/b", "**/b"},
+	{"!/a/", "a negate dirOnly"},
+	{"/", ""},
+	{"!", ""},
+	{"[", ""},
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	for _, tt := range parseIgnoreTests {
+		r := parseIgnoreRule(tt.line)
+		got := ""
+		if r != nil {
+			got = r.pattern
+			if r.negate {
+				got += " negate"
+			}
+			if r.dirOnly {
+				got += " dirOnly"
+			}
+			if r.base {
+				got += " base"
+			}
+		}
+		if got != tt.rule {
+			t.Errorf("parseIgnoreRule(%q) = %q, want %q", tt.line, got, tt.rule)
+		}
+	}
+}
+
+var ignoreTree = map[string]string{
+	".gitignore":          "outside.txt\n",
+	"tree/.gitignore":     "# comment\n\n*.log\n!keep.log\n/top.txt\nbuild/\nsub/**/deep.txt\n",
+	"tree/sub/.gitignore": "!*.log\nlocal.txt\n",
+	"tree/sub/.ignore":    "!local.txt\nsub.txt\n",
+	"repo/.gitignore":     "*.tmp\n",
+	"repo/src/.gitignore": "!keep.tmp\n",
+}
+
+var ignoredByTests = []struct {
+	root  string
+	path  string
+	isDir bool
+	rule  string // file:line of the rule ignoring path, or ""
+}{
+	// Outside a repository, the rules above the root do not apply.
+	{"tree", "tree/outside.txt", false, ""},
+	{"tree/sub", "tree/sub/a.txt", false, ""},
+	{"tree/sub", "tree/sub/local.txt", false, ""},
+	{"tree/sub", "tree/sub/sub.txt", false, "tree/sub/.ignore:2"},
+
+	{"tree", "tree/a.log", false, "tree/.gitignore:3"},
+	{"tree", "tree/x/a.log", false, "tree/.gitignore:3"},
+	{"tree", "tree/keep.log", false, ""},
+
+	// Anchored rules match only next to the ignore file.
+	{"tree", "tree/top.txt", false, "tree/.gitignore:5"},
+	{"tree", "tree/x/top.txt", false, ""},
+
+	// Directory-only rules.
+	{"tree", "tree/build", true, "tree/.gitignore:6"},
+	{"tree", "tree/x/build", true, "tree/.gitignore:6"},
+	{"tree", "tree/build", false, ""},
+
+	// **.
+	{"tree", "tree/sub/deep.txt", false, "tree/.gitignore:7"},
+	{"tree", "tree/sub/x/y/deep.txt", false, "tree/.gitignore:7"},
+	{"tree", "tree/deep.txt", false, ""},
+
+	// Rules in a subdirectory override those above it,
+	// and .ignore overrides .gitignore.
+	{"tree", "tree/sub/a.log", false, ""},
+	{"tree", "tree/sub/x/a.log", false, ""},
+	{"tree", "tree/sub/local.txt", false, ""},
+	{"tree", "tree/x/local.txt", false, ""},
+
+	{"tree", "tree/.git", true, ".git/"},
+
+	// In a repository, the rules apply up to its root, but no further.
+	{"repo/src", "repo/src/a.tmp", false, "repo/.gitignore:1"},
+	{"repo/src", "repo/src/keep.tmp", false, ""},
+	{"repo/src", "repo/src/outside.txt", false, ""},
+	{"repo/src/a.tmp", "repo/src/a.tmp", false, "repo/.gitignore:1"},
+}
+
+func TestIgnoredBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range ignoreTree {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "repo", ".git"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "repo", "src", "a.tmp"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(on bool) { *gitignoreFlag = on }(*gitignoreFlag)
+	*gitignoreFlag = true
+	forgetIgnoreRules()
+	defer forgetIgnoreRules()
+
+	for _, tt := range ignoredByTests {
+		root := filepath.Join(dir, tt.root)
+		path := filepath.Join(dir, tt.path)
+		got := ""
+		if r := ignoredBy(root, path, tt.isDir); r == gitDirRule {
+			got = r.text
+		} else if r != nil {
+			rel, _ := filepath.Rel(dir, r.file)
+			got = fmt.Sprintf("%s:%d", filepath.ToSlash(rel), r.line)
+		}
+		if got != tt.rule {
+			t.Errorf("ignoredBy(%s, %s, %v) = %q, want %q", tt.root, tt.path, tt.isDir, got, tt.rule)
+		}
+	}
+}
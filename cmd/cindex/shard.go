@@ -0,0 +1,208 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+// openManifest returns the manifest of the sharded index in dir,
+// creating the directory if needed.
+func openManifest(dir string) *index.Manifest {
+	if !index.IsSharded(dir) {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatal(err)
+		}
+		return &index.Manifest{Dir: dir}
+	}
+	m, err := index.ReadManifest(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+// writeManifest writes m, after a change to its shards.
+func writeManifest(m *index.Manifest) {
+	if err := m.Write(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeBuiltManifest writes m as it stands while some of its new shards
+// are still to be built: without the unbuilt shards, which have no index
+// files yet, and with the shards they are to replace instead.
+func writeBuiltManifest(m *index.Manifest, unbuilt map[*index.Shard]bool, replaced map[*index.Shard][]*index.Shard) {
+	built := &index.Manifest{Dir: m.Dir}
+	for _, sh := range m.Shards {
+		if unbuilt[sh] {
+			built.Shards = append(built.Shards, replaced[sh]...)
+			continue
+		}
+		built.Shards = append(built.Shards, sh)
+	}
+	writeManifest(built)
+}
+
+// refreshPaths sets the paths of the shard sh to those of its index.
+func refreshPaths(m *index.Manifest, sh *index.Shard) {
+	ix := index.Open(m.File(sh))
+	sh.Paths = ix.Paths()
+	ix.Close()
+}
+
+// updateShards indexes the paths in the sharded index in dir, each in
+// the shard covering it, or else in a new shard.  Only those shards are
+// updated, one at a time.  With no paths, every shard is reindexed.
+// A new shard takes over the shards with paths under its own, so that
+// no file is indexed in two shards; they are deleted once it is built.
+func updateShards(dir string, paths []string) {
+	m := openManifest(dir)
+	if *resetFlag && len(m.Shards) > 0 {
+		if err := m.Delete(); err != nil {
+			log.Fatal(err)
+		}
+		m = openManifest(dir)
+	}
+
+	var (
+		order    []*index.Shard
+		work     = make(map[*index.Shard][]string)
+		unbuilt  = make(map[*index.Shard]bool)           // new shards
+		replaced = make(map[*index.Shard][]*index.Shard) // by each new shard
+	)
+	if len(paths) == 0 {
+		for _, sh := range m.Shards {
+			order = append(order, sh)
+			work[sh] = sh.Paths
+		}
+	}
+	for _, p := range paths {
+		sh := m.Lookup(p)
+		if sh == nil {
+			// The paths are sorted, so any paths under p
+			// come after it and go into the same new shard.
+			sh = m.NewShard()
+			sh.Paths = []string{p}
+			unbuilt[sh] = true
+			order = append(order, sh)
+			for _, old := range m.Overlapping(p) {
+				if old != sh {
+					fold(m, sh, old, work, unbuilt, replaced)
+				}
+			}
+		}
+		if _, ok := work[sh]; !ok && !unbuilt[sh] {
+			order = append(order, sh)
+		}
+		work[sh] = append(work[sh], p)
+	}
+
+	for _, sh := range order {
+		if _, ok := work[sh]; !ok {
+			continue // folded into a new shard
+		}
+		sort.Strings(work[sh])
+		log.Printf("update shard %s: %s", sh.Name, strings.Join(work[sh], " "))
+		update(m.File(sh), work[sh])
+		refreshPaths(m, sh)
+		delete(unbuilt, sh)
+		writeBuiltManifest(m, unbuilt, replaced)
+		for _, old := range replaced[sh] {
+			log.Printf("delete shard %s, now part of %s", old.Name, sh.Name)
+			os.Remove(m.File(old))
+		}
+		delete(replaced, sh)
+	}
+}
+
+// fold moves the paths of the shard old, which has paths under those
+// of the new shard sh, into sh, and drops old from the manifest m.
+// The files of the paths under those of sh were going to be indexed
+// in sh already; the others are indexed in it too.
+func fold(m *index.Manifest, sh, old *index.Shard, work map[*index.Shard][]string, unbuilt map[*index.Shard]bool, replaced map[*index.Shard][]*index.Shard) {
+	for _, p := range old.Paths {
+		if rootOf(sh.Paths, p) == "" {
+			sh.Paths = append(sh.Paths, p)
+			work[sh] = append(work[sh], p)
+		}
+	}
+	delete(work, old)
+	m.Remove(old)
+	if unbuilt[old] {
+		delete(unbuilt, old)
+		replaced[sh] = append(replaced[sh], replaced[old]...)
+		delete(replaced, old)
+	} else {
+		replaced[sh] = append(replaced[sh], old)
+	}
+}
+
+// removeShards removes the paths from the sharded index in dir,
+// rewriting only the shards that have files under them.
+// Shards left without paths are deleted.
+func removeShards(dir string, paths []string) {
+	m := openManifest(dir)
+	var order []*index.Shard
+	remove := make(map[*index.Shard][]string) // paths to remove from each shard
+	for _, p := range paths {
+		for _, sh := range m.Overlapping(p) {
+			if remove[sh] == nil {
+				order = append(order, sh)
+			}
+			remove[sh] = append(remove[sh], p)
+		}
+	}
+	for _, sh := range order {
+		file := m.File(sh)
+		log.Printf("remove from shard %s: %s", sh.Name, strings.Join(remove[sh], " "))
+		index.Remove(file+"~", file, remove[sh])
+		replaceIndex(file, file+"~")
+		refreshPaths(m, sh)
+		if len(sh.Paths) == 0 {
+			m.Remove(sh)
+			writeManifest(m)
+			os.Remove(file)
+			continue
+		}
+		writeManifest(m)
+	}
+	log.Printf("done")
+}
+
+// resetShards deletes the sharded index in dir.
+func resetShards(dir string) {
+	m, err := index.ReadManifest(dir)
+	if err != nil {
+		// does not exist so nothing to do
+		return
+	}
+	if err := m.Delete(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listShards prints the paths indexed in the sharded index in dir.
+func listShards(dir string) {
+	m, err := index.ReadManifest(dir)
+	if err != nil {
+		log.Fatal("Index " + dir + " is not accessible")
+	}
+	var paths []string
+	for _, sh := range m.Shards {
+		paths = append(paths, sh.Paths...)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Printf("%s\n", p)
+	}
+}
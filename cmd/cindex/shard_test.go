@@ -0,0 +1,78 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+func TestUpdateShardsNested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	a, b, c := filepath.Join(src, "a"), filepath.Join(src, "a", "b"), filepath.Join(src, "c")
+	for _, name := range []string{filepath.Join(a, "x"), filepath.Join(b, "y"), filepath.Join(c, "z")} {
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("hello world\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shards := filepath.Join(dir, "shards")
+	updateShards(shards, []string{b})
+	// Put c in b's shard too.
+	m, err := index.ReadManifest(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Shards) != 1 {
+		t.Fatalf("%d shards, want 1", len(m.Shards))
+	}
+	old := m.File(m.Shards[0])
+	update(old, []string{b, c})
+	refreshPaths(m, m.Shards[0])
+	writeManifest(m)
+
+	updateShards(shards, []string{a})
+	m, err = index.ReadManifest(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Shards) != 1 {
+		t.Fatalf("%d shards after indexing %s, want 1", len(m.Shards), a)
+	}
+	if want := []string{a, c}; !reflect.DeepEqual(m.Shards[0].Paths, want) {
+		t.Errorf("shard paths %q, want %q", m.Shards[0].Paths, want)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old shard %s not deleted", old)
+	}
+
+	mi := index.OpenMulti([]string{shards})
+	defer mi.Close()
+	var names []string
+	for _, ix := range mi.Indexes {
+		for _, fileid := range ix.PostingQuery(&index.Query{Op: index.QAll}) {
+			names = append(names, ix.Name(fileid))
+		}
+	}
+	want := []string{filepath.Join(b, "y"), filepath.Join(a, "x"), filepath.Join(c, "z")}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("indexed files %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+// Reasons for skipping a path while walking the indexed trees,
+// in addition to the index.Skip reasons reported by the IndexWriter.
+const (
+	skipExcluded          = "excluded"           // matched an -exclude rule
+	skipIgnored           = "ignored"            // Detail is the ignore rule
+	skipSymlink           = "symlink"            // symlink with -no-follow-symlinks
+	skipSymlinkUnresolved = "symlink-unresolved" // Detail is the error
+	skipUnsupported       = "unsupported-type"   // not a file, directory or symlink
+	skipStat              = "stat-error"         // could not be stat'ed
+)
+
+// A skipRecord is a line of the -skipreport file.
+type skipRecord struct {
+	Path   string   `json:"path"`
+	Reason string   `json:"reason"`
+	Value  *float64 `json:"value,omitempty"`
+	Limit  *float64 `json:"limit,omitempty"`
+	Detail string   `json:"detail,omitempty"`
+}
+
+// skips counts the skipped paths by reason and writes them
+// to the -skipreport file, if any.
+var skips struct {
+	sync.Mutex
+	counts map[string]int
+	file   *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+}
+
+// openSkipReport starts writing the skip report to the named file.
+func openSkipReport(name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	skips.file = f
+	skips.w = bufio.NewWriter(f)
+	skips.enc = json.NewEncoder(skips.w)
+}
+
+// flushSkipReport writes out the records buffered for the skip report.
+func flushSkipReport() {
+	skips.Lock()
+	defer skips.Unlock()
+	if skips.w == nil {
+		return
+	}
+	if err := skips.w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// closeSkipReport finishes writing the skip report.
+// Paths skipped afterwards are only counted.
+func closeSkipReport() {
+	flushSkipReport()
+	skips.Lock()
+	defer skips.Unlock()
+	if skips.file == nil {
+		return
+	}
+	if err := skips.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+	skips.file = nil
+	skips.w = nil
+	skips.enc = nil
+}
+
+// skipped records that path was skipped for the given reason,
+// with a detail such as an error or ignore rule, which may be empty.
+func skipped(path, reason, detail string) {
+	record(&skipRecord{Path: path, Reason: reason, Detail: detail})
+}
+
+// indexSkipped records a file that the IndexWriter did not index.
+func indexSkipped(s *index.Skip) {
+	r := &skipRecord{Path: s.Name, Reason: s.Reason}
+	switch s.Reason {
+	case index.SkipError:
+		r.Detail = s.Err.Error()
+	case index.SkipBinary:
+		r.Value = &s.Value
+	default:
+		r.Value = &s.Value
+		r.Limit = &s.Limit
+	}
+	record(r)
+}
+
+func record(r *skipRecord) {
+	skips.Lock()
+	defer skips.Unlock()
+	if skips.counts == nil {
+		skips.counts = make(map[string]int)
+	}
+	skips.counts[r.Reason]++
+	if skips.enc != nil {
+		if err := skips.enc.Encode(r); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// logSkipSummary logs the number of paths skipped for each reason
+// and resets the counts.
+func logSkipSummary() {
+	skips.Lock()
+	defer skips.Unlock()
+	var reasons []string
+	for reason := range skips.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		log.Printf("skipped %d paths: %s", skips.counts[reason], reason)
+	}
+	skips.counts = nil
+}
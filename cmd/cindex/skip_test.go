@@ -0,0 +1,45 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSkipReportClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer logSkipSummary()
+
+	file := filepath.Join(dir, "skips")
+	openSkipReport(file)
+	skipped("/a/before", skipExcluded, "")
+	flushSkipReport()
+	skipped("/a/flushed", skipExcluded, "")
+	closeSkipReport()
+	skipped("/a/after", skipIgnored, "*.o")
+	closeSkipReport()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"/a/before","reason":"excluded"}
+{"path":"/a/flushed","reason":"excluded"}
+`
+	if string(data) != want {
+		t.Errorf("skip report:\n%s\nwant:\n%s", data, want)
+	}
+	if n := skips.counts[skipIgnored]; n != 1 {
+		t.Errorf("%d paths counted as %s after close, want 1", n, skipIgnored)
+	}
+}
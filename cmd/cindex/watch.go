@@ -0,0 +1,188 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+// watch keeps the index in master up to date by watching the indexed
+// paths for changes and merging the changed files into the index.
+// The merges run in the background, so that changes made meanwhile
+// are read, and batched for the next merge, before the kernel's queue
+// of them overflows.  It does not return.
+func watch(master string) {
+	ix := index.Open(master)
+	roots := ix.Paths()
+	version := ix.Version()
+	ix.Close()
+
+	w, err := newWatcher(master, roots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("watching %d paths", len(roots))
+	batch(w.C, func(paths []string) {
+		updateIndex(master, roots, paths, version)
+	})
+}
+
+// batch collects the changed paths read from c into batches, and calls
+// update with each batch, sorted, once the changes have settled down for
+// the -watchdelay, but at most every -watchinterval.  The calls run in
+// the background, one at a time, while the changes made meanwhile are
+// batched for the next.  batch returns when c is closed and the last
+// call, if any, is done; the changes still pending are dropped.
+func batch(c <-chan string, update func(paths []string)) {
+	var (
+		pending    = make(map[string]bool)
+		batchStart time.Time // time of first change in pending
+		lastMerge  time.Time
+		merging    bool // a merge is running
+		merged     = make(chan bool)
+		timer      = time.NewTimer(time.Hour)
+	)
+	timer.Stop()
+	for {
+		select {
+		case path, ok := <-c:
+			if !ok {
+				if merging {
+					<-merged
+				}
+				return
+			}
+			if len(pending) == 0 {
+				batchStart = time.Now()
+			}
+			pending[path] = true
+			// Wait for the changes to settle down,
+			// but do not let a steady trickle of changes
+			// postpone the update forever.
+			d := *watchDelay
+			if max := batchStart.Add(*watchInterval).Sub(time.Now()); max < d {
+				d = max
+			}
+			timer.Reset(d)
+
+		case <-timer.C:
+			if len(pending) == 0 || merging {
+				// A running merge restarts the timer when done.
+				break
+			}
+			if wait := lastMerge.Add(*watchInterval).Sub(time.Now()); wait > 0 {
+				timer.Reset(wait)
+				break
+			}
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			pending = make(map[string]bool)
+			merging = true
+			go func() {
+				update(paths)
+				merged <- true
+			}()
+
+		case <-merged:
+			merging = false
+			lastMerge = time.Now()
+			if len(pending) > 0 {
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+// updateIndex reindexes the given changed paths, in the trees rooted at
+// roots, and merges them into the index in master.  Paths that no longer
+// exist are removed from it.
+func updateIndex(master string, roots, paths []string, version int) {
+	log.Printf("update %d changed paths", len(paths))
+	changed := make(map[string]bool)
+	var changedRoots, existing, existingRoots []string
+	for _, path := range paths {
+		changed[path] = true
+		root := rootOf(roots, path)
+		if root == "" {
+			root = path
+		}
+		if rootOf(changedRoots, root) == "" {
+			changedRoots = append(changedRoots, root)
+		}
+		if _, err := os.Lstat(path); err == nil {
+			existing = append(existing, path)
+			existingRoots = append(existingRoots, root)
+		}
+	}
+	sort.Strings(changedRoots)
+
+	// The new index lists the roots of the changed paths, so the
+	// merge drops the files of the index under them, including the
+	// deleted files, in favor of their new versions, except for the
+	// files not under a changed path, which it is told to keep.
+	old := index.Open(master)
+	var keep []uint32
+	for _, id := range old.PostingQuery(&index.Query{Op: index.QAll}) {
+		name := old.Name(id)
+		if rootOf(changedRoots, name) != "" && !under(changed, name) {
+			keep = append(keep, id)
+		}
+	}
+	old.Close()
+
+	file := master + "~"
+	ix := newWriter(file, version)
+	ix.AddPaths(changedRoots)
+	indexPaths(ix, nil, existingRoots, existing)
+	ix.Flush()
+	ix.Close()
+	logSkipSummary()
+	flushSkipReport()
+	mergeIndex(master, file, keep, 0)
+	log.Printf("done")
+}
+
+// under reports whether name is one of the paths in the set
+// or lies in a directory tree rooted at one of them.
+func under(set map[string]bool, name string) bool {
+	for {
+		if set[name] {
+			return true
+		}
+		dir := filepath.Dir(name)
+		if dir == name {
+			return false
+		}
+		name = dir
+	}
+}
+
+// rootOf returns the root of the indexed tree containing path,
+// or "" if path lies in none of them.
+func rootOf(roots []string, path string) string {
+	path = filepath.Clean(path)
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		dir := root
+		if !strings.HasSuffix(dir, string(filepath.Separator)) {
+			dir += string(filepath.Separator)
+		}
+		if path == root || strings.HasPrefix(path, dir) {
+			return root
+		}
+	}
+	return ""
+}
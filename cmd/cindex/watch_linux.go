@@ -0,0 +1,184 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// A watcher uses inotify to report changes to the files
+// in a set of directory trees.
+type watcher struct {
+	C chan string // changed paths
+
+	fd     int
+	master string           // index file, whose changes are ignored
+	roots  []string         // roots of the watched trees
+	dirs   map[int32]string // watched directory, by watch descriptor
+}
+
+func newWatcher(master string, roots []string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		C:      make(chan string, 1024),
+		fd:     fd,
+		master: master,
+		roots:  roots,
+		dirs:   make(map[int32]string),
+	}
+	for _, root := range roots {
+		w.addRoot(root)
+	}
+	go w.run()
+	return w, nil
+}
+
+// addRoot watches the tree rooted at root.  The directory containing
+// root is watched too, to see root being created, moved or deleted,
+// and to watch root through it when root is a file.
+func (w *watcher) addRoot(root string) {
+	w.add(filepath.Dir(root))
+	if fi, err := os.Stat(root); err == nil && fi.IsDir() {
+		w.addTree(root, root)
+	}
+}
+
+// add watches the directory dir.
+func (w *watcher) add(dir string) {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask|syscall.IN_ONLYDIR)
+	if err != nil {
+		log.Printf("%s: cannot watch: %v", dir, err)
+		return
+	}
+	w.dirs[int32(wd)] = dir
+}
+
+// addTree watches every directory in the tree rooted at dir,
+// which lies in the watched tree rooted at root.
+func (w *watcher) addTree(root, dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != dir && (excluded(root, path, true) || ignoredBy(root, path, true) != nil) {
+			return filepath.SkipDir
+		}
+		w.add(path)
+		return nil
+	})
+}
+
+// run reads inotify events and reports the changed paths on w.C.
+func (w *watcher) run() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := syscall.Read(w.fd, buf[:])
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Fatalf("reading inotify events: %v", err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+			w.event(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+// event handles a single inotify event.
+func (w *watcher) event(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost, so anything might have changed.
+		// Directories created meanwhile may not be watched yet.
+		log.Printf("inotify queue overflow; reindexing everything")
+		for _, root := range w.roots {
+			w.addRoot(root)
+			w.C <- root
+		}
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+	if mask&(syscall.IN_MOVE_SELF|syscall.IN_DELETE_SELF) != 0 {
+		w.gone(dir)
+		return
+	}
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	if strings.HasPrefix(path, w.master) {
+		return
+	}
+	root := rootOf(w.roots, path)
+	if root == "" {
+		// A change next to a file root, in a directory
+		// that is watched only for the file root's sake.
+		return
+	}
+	if name != "" && excluded(root, path, mask&syscall.IN_ISDIR != 0) {
+		return
+	}
+	if *gitignoreFlag && isIgnoreFile(name) {
+		// Changed rules apply from now on; paths already
+		// indexed stay until their tree is reindexed.
+		forgetIgnoreRules()
+	}
+	if ignoredBy(root, path, mask&syscall.IN_ISDIR != 0) != nil {
+		return
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		w.addTree(root, path)
+	}
+	w.C <- path
+}
+
+// gone handles the watched directory dir being moved or deleted.
+// A directory moved within the watched trees has been watched again
+// under its new name already, when its parent reported it.  Otherwise
+// the watches on dir and the directories under it are dropped, as
+// they no longer watch the paths they were added for.  The parent of
+// dir reports the change to it, even if dir is a root, whose parent
+// also sees a directory created in its place.
+func (w *watcher) gone(dir string) {
+	if fi, err := os.Lstat(dir); err == nil && fi.IsDir() {
+		return
+	}
+	for wd, d := range w.dirs {
+		if d == dir || strings.HasPrefix(d, dir+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+	for _, root := range w.roots {
+		if dir == root {
+			log.Printf("%s: moved or deleted; waiting for it to reappear", root)
+			w.C <- root
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package main
+
+import "errors"
+
+// A watcher reports changes to the files in a set of directory trees.
+type watcher struct {
+	C chan string // changed paths
+}
+
+func newWatcher(master string, roots []string) (*watcher, error) {
+	return nil, errors.New("cindex -watch is only supported on Linux")
+}
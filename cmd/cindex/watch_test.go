@@ -0,0 +1,182 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+var rootOfTests = []struct {
+	roots []string
+	path  string
+	root  string
+}{
+	{[]string{"/a", "/b"}, "/a", "/a"},
+	{[]string{"/a", "/b"}, "/a/x/y", "/a"},
+	{[]string{"/a", "/b"}, "/b/x", "/b"},
+	{[]string{"/a", "/b"}, "/ab", ""},
+	{[]string{"/a", "/b"}, "/c/a", ""},
+	{[]string{"/a/"}, "/a/x", "/a"},
+	{[]string{"/a"}, "/a/x/../y", "/a"},
+	{[]string{"/"}, "/x", "/"},
+	{[]string{"/a/f.go"}, "/a/f.go", "/a/f.go"},
+	{[]string{"/a/f.go"}, "/a/f.go2", ""},
+	{nil, "/a", ""},
+}
+
+func TestRootOf(t *testing.T) {
+	for _, tt := range rootOfTests {
+		roots := make([]string, len(tt.roots))
+		for i, r := range tt.roots {
+			roots[i] = filepath.FromSlash(r)
+		}
+		if root := rootOf(roots, filepath.FromSlash(tt.path)); root != filepath.FromSlash(tt.root) {
+			t.Errorf("rootOf(%q, %q) = %q, want %q", tt.roots, tt.path, root, tt.root)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	defer func(d, i time.Duration) { *watchDelay, *watchInterval = d, i }(*watchDelay, *watchInterval)
+	*watchDelay = 20 * time.Millisecond
+	*watchInterval = 100 * time.Millisecond
+
+	c := make(chan string)
+	batches := make(chan []string)
+	release := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		batch(c, func(paths []string) {
+			batches <- paths
+			<-release
+		})
+		close(done)
+	}()
+
+	c <- "/r/b"
+	c <- "/r/a"
+	c <- "/r/b"
+	if b := <-batches; !reflect.DeepEqual(b, []string{"/r/a", "/r/b"}) {
+		t.Errorf("first batch %q, want [/r/a /r/b]", b)
+	}
+
+	// Changes made during an update wait for the next one.
+	c <- "/r/c"
+	c <- "/r/a"
+	select {
+	case b := <-batches:
+		t.Fatalf("batch %q during an update", b)
+	case <-time.After(3 * *watchDelay):
+	}
+	release <- true
+	if b := <-batches; !reflect.DeepEqual(b, []string{"/r/a", "/r/c"}) {
+		t.Errorf("second batch %q, want [/r/a /r/c]", b)
+	}
+	release <- true
+
+	// A steady trickle of changes does not postpone the update forever.
+	start := time.Now()
+	for b := []string(nil); b == nil; {
+		select {
+		case c <- "/r/d":
+			time.Sleep(*watchDelay / 4)
+		case b = <-batches:
+		}
+		if time.Since(start) > 50**watchInterval {
+			t.Fatal("no update during a steady trickle of changes")
+		}
+	}
+	release <- true
+
+	close(c)
+	<-done
+}
+
+// indexedNames returns the paths and the names of the files in the index file.
+func indexedNames(t *testing.T, file string) (paths, names []string) {
+	ix := index.Open(file)
+	defer ix.Close()
+	for _, id := range ix.PostingQuery(&index.Query{Op: index.QAll}) {
+		names = append(names, ix.Name(id))
+	}
+	return ix.Paths(), names
+}
+
+func TestUpdateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, other := filepath.Join(dir, "src"), filepath.Join(dir, "other")
+	write := func(name, data string) {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("src/a", "hello world\n")
+	write("src/b", "hello world\n")
+	write("src/sub/c", "hello world\n")
+	write("src/sub/d", "hello world\n")
+	write("other/x", "hello world\n")
+	master := filepath.Join(dir, "index")
+	roots := []string{other, src}
+	update(master, roots)
+
+	// Edit a file, delete one and create another.
+	write("src/a", "goodbye world\n")
+	if err := os.Remove(filepath.Join(src, "b")); err != nil {
+		t.Fatal(err)
+	}
+	write("src/e", "hello again\n")
+	updateIndex(master, roots, []string{filepath.Join(src, "a"), filepath.Join(src, "b"), filepath.Join(src, "e")}, 1)
+
+	paths, names := indexedNames(t, master)
+	if !reflect.DeepEqual(paths, roots) {
+		t.Errorf("paths after update %q, want %q", paths, roots)
+	}
+	want := []string{
+		filepath.Join(other, "x"),
+		filepath.Join(src, "a"),
+		filepath.Join(src, "e"),
+		filepath.Join(src, "sub", "c"),
+		filepath.Join(src, "sub", "d"),
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("names after update %q, want %q", names, want)
+	}
+	ix := index.Open(master)
+	post := ix.PostingQuery(index.LiteralQuery("goodbye"))
+	if len(post) != 1 || ix.Name(post[0]) != filepath.Join(src, "a") {
+		t.Errorf("edited file not reindexed: %v", post)
+	}
+	ix.Close()
+
+	// Delete a directory.
+	if err := os.RemoveAll(filepath.Join(src, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	updateIndex(master, roots, []string{filepath.Join(src, "sub")}, 1)
+	paths, names = indexedNames(t, master)
+	if !reflect.DeepEqual(paths, roots) {
+		t.Errorf("paths after deleting a directory %q, want %q", paths, roots)
+	}
+	if want = want[:3]; !reflect.DeepEqual(names, want) {
+		t.Errorf("names after deleting a directory %q, want %q", names, want)
+	}
+}
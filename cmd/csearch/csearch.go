@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"runtime/pprof"
 
 	"github.com/junkblocker/codesearch/index"
@@ -18,30 +19,110 @@ import (
 )
 
 var usageMessage = `usage: csearch [options] regexp
+       csearch [options] -e regexp [-e regexp...]
+       csearch [options] -patterns FILE
 
 Options:
 
+  -A NUM       print NUM lines of context after each matching line
+  -B NUM       print NUM lines of context before each matching line
+  -C NUM       print NUM lines of context before and after each matching
+               line, unless overridden by -A or -B
   -c           print only a count of selected lines to stdout
                (Not meaningful with -l or -M modes)
+  -color WHEN  highlight file names, line numbers and matches: WHEN is
+               auto (the default: only if stdout is a terminal), always
+               or never
+  -column      print the 1-based byte column of the first match in each
+               matching line, after the line number
+  -e REGEXP    search for REGEXP; may be repeated to search for lines
+               matching any of several regexps
+  -F           search for fixed strings instead of regexps
   -f PATHREGEXP
                search only files with names matching this regexp
+  -exclude-f PATHREGEXP
+               do not search files with names matching this regexp;
+               may be repeated
+  -g GLOB      search only files with names matching GLOB or, if GLOB
+               starts with !, not matching it; may be repeated
   -h           print this help text and exit
   -i           case-insensitive search
+  -json        print results as JSON Lines, one object per line
   -l           print only the names of the files containing matches
                (Not meaningful with -c or -M modes)
-  -0           print -l matches separated by NUL ('\0') character
+  -L           print only the names of the files containing no matches
+               (Not meaningful with -c, -l or -M modes)
+  -0           print -l or -L matches separated by NUL ('\0') character
   -m MAXCOUNT  limit search output results to MAXCOUNT (0: no limit)
   -M MAXCOUNT  limit search output results to MAXCOUNT per file (0: no limit)
                (Not allowed with -c or -l modes)
   -n           print each output line preceded by its relative line number in
                the file, starting at 1
+  -o           print only the matched parts of matching lines, each on its
+               own line (with -column, preceded by its own column)
+  -patterns FILE
+               search for the regexps in FILE, one per line, as well as
+               those given with -e
+  -S           smart case: ignore case in each regexp without upper-case
+               letters; -S=false turns it off if $CSEARCHSMARTCASE is set
+  -showpattern print the number of the first regexp matching each line,
+               counting from 1 in the order given by -e and -patterns,
+               after the line number and column
+  -v           select the lines that do not match instead of those that do
+  -w           select only lines where the match is a whole word, starting
+               and ending at word boundaries (\b)
+  -x           select only lines matched as a whole
   -indexpath FILE
                use specified FILE as the index path. Overrides $CSEARCHINDEX.
+               FILE may be a list of index files, as in $CSEARCHINDEX.
+               A sharded index is given by its directory.
   -verbose     print extra information
+  -workers N   search N files at a time (default: the number of CPUs);
+               the output is the same as when searching them one by one
   -brute       brute force - search all files in index
   -cpuprofile FILE
                write CPU profile to FILE
 
+With -A, -B or -C, context lines are marked with '-' instead of ':' after
+the file name and line number, and non-adjacent groups of lines are
+separated by a line containing '--'.  Context is not printed with -c or -l.
+
+With -json, csearch prints a JSON object per line instead of text, which
+suits tools that must cope with any file name.  A matching line is printed as
+
+	{"type":"match","path":"a.go","line":3,"offset":52,
+	 "matches":[{"start":5,"end":9}],"text":"func main() {"}
+
+(on a single line), where offset is the byte offset of the line in the
+file, matches holds the byte offsets of each match within the line, and
+text is the line without its newline.  With -showpattern, a matching line
+also has a "pattern" number.  Context lines have type "context" and no
+matches.  A path or line that is not valid UTF-8 is given in base64
+as path_base64 or text_base64 instead.  With -l, each file is printed as
+{"type":"file","path":...}; with -c, as {"type":"count","path":...,"count":N}.
+
+With -v or -L, csearch cannot use the index to narrow the search and reads
+every indexed file, as with -brute.  With -L, the exit status is 0 if some
+file is listed.
+
+A -g glob without a slash, like *.go, is matched against the last element
+of each file name, and one with a slash, like cmd/**/*.go, against any
+trailing sequence of its elements.  ** matches any number of elements.
+A file is searched only if it matches some -g glob without !, if any, and
+no -g glob with ! or -exclude-f regexp.  For example,
+
+	csearch -g '*.go' -g '!*_test.go' -exclude-f /vendor/ regexp
+
+searches the Go files outside vendor directories, excluding tests.
+
+For a quickfix list in vim's vimgrep format, file:line:col:text, use
+
+	csearch -n -column regexp
+
+The colors used by -color are read from $GREP_COLORS, in the format used
+by GNU grep, for example ms=01;31:fn=35:ln=32:se=36 (the defaults).  The
+capabilities ms (or mt), sl, cx, fn, ln, se and ne are recognized.
+
 As per Go's flag parsing convention, the flags cannot be combined: the option
 pair -i -n cannot be abbreviated to -in.
 
@@ -58,11 +139,20 @@ the index. If no index exists, this command creates one.  If an index already
 exists, cindex overwrites it.  Run cindex -help for more.
 
 csearch uses the index stored in $CSEARCHINDEX or, if that variable is unset or
-empty, $HOME/.csearchindex.
+empty, $HOME/.csearchindex.  $CSEARCHINDEX may also list several index files,
+separated by colons (semicolons on Windows) as in $PATH, to search them all.
+Where indexes cover the same files, the most recently built one is used.
+A sharded index, made by cindex -shards, is named by its directory, and
+csearch queries all its shards in parallel.
+
+Setting $CSEARCHSMARTCASE to 1 or true turns -S on by default, in csearch
+and cgrep.  Smart case looks only at the letters the regexp matches
+literally: escapes such as \S and \W and character classes such as [A-Z]
+do not count as upper case.
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage)
+	fmt.Fprint(os.Stderr, usageMessage)
 	os.Exit(2)
 }
 
@@ -75,6 +165,9 @@ var (
 	indexPath       = flag.String("indexpath", "", "specifies index path")
 	maxCount        = flag.Int64("m", 0, "specified maximum number of search results")
 	maxCountPerFile = flag.Int64("M", 0, "specified maximum number of search results per file")
+	workersFlag     = flag.Int("workers", runtime.NumCPU(), "search this many files at a time")
+	excludeFFlag    listFlag
+	globFlag        listFlag
 
 	matches bool
 )
@@ -85,12 +178,19 @@ func Main() {
 		Stderr: os.Stderr,
 	}
 	g.AddFlags()
+	flag.Var(&excludeFFlag, "exclude-f", "do not search files with names matching this regexp (may be repeated)")
+	flag.Var(&globFlag, "g", "search only files matching this glob, or not matching it if it starts with ! (may be repeated)")
 
 	flag.Usage = usage
 	flag.Parse()
-	args := flag.Args()
+	exprs, args, err := g.Exprs(flag.Args())
+	if err != nil {
+		log.Print(err)
+		usage()
+	}
 
-	if len(args) != 1 || (g.L && g.C) || (g.L && *maxCountPerFile > 0) || (g.C && *maxCountPerFile > 0) {
+	if len(args) != 0 || (g.L && g.C) || (g.L && *maxCountPerFile > 0) || (g.C && *maxCountPerFile > 0) ||
+		(g.FilesWithoutMatch && (g.L || g.C || *maxCountPerFile > 0)) {
 		usage()
 	}
 
@@ -111,66 +211,53 @@ func Main() {
 		}
 	}
 
-	pat := "(?m)" + args[0]
-	if *iFlag {
-		pat = "(?i)" + pat
-	}
-	re, err := regexp.Compile(pat)
+	re, err := g.Compile(exprs, *iFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 	g.Regexp = re
-	var fre *regexp.Regexp
-	if *fFlag != "" {
-		fre, err = regexp.Compile(*fFlag)
-		if err != nil {
-			log.Fatal(err)
-		}
+	nf, err := newNameFilter(*fFlag, excludeFFlag, globFlag)
+	if err != nil {
+		log.Fatal(err)
 	}
-	q := index.RegexpQuery(re.Syntax)
+	q := re.IndexQuery()
 	if *verboseFlag {
 		log.Printf("query: %s\n", q)
 	}
 
-	ix := index.Open(index.File())
-	ix.Verbose = *verboseFlag
-	var post []uint32
-	if *bruteFlag {
-		post = ix.PostingQuery(&index.Query{Op: index.QAll})
-	} else {
-		post = ix.PostingQuery(q)
+	ix := index.OpenMulti(index.Files())
+	for _, x := range ix.Indexes {
+		x.Verbose = *verboseFlag
 	}
+	if *bruteFlag || g.V || g.FilesWithoutMatch {
+		// The index can only rule out files that cannot match,
+		// not those that might have lines that do not.
+		q = &index.Query{Op: index.QAll}
+	}
+	names := ix.Names(q)
 	if *verboseFlag {
-		log.Printf("post query identified %d possible files\n", len(post))
+		log.Printf("post query identified %d possible files\n", len(names))
 	}
 
-	if fre != nil {
-		fnames := make([]uint32, 0, len(post))
+	if !nf.empty() {
+		fnames := make([]string, 0, len(names))
 
-		for _, fileid := range post {
-			name := ix.Name(fileid)
-			if fre.MatchString(name, true, true) < 0 {
+		for _, name := range names {
+			if !nf.match(name) {
 				continue
 			}
-			fnames = append(fnames, fileid)
+			fnames = append(fnames, name)
 		}
 
 		if *verboseFlag {
-			log.Printf("filename regexp matched %d files\n", len(fnames))
+			log.Printf("filename filters matched %d files\n", len(fnames))
 		}
-		post = fnames
+		names = fnames
 	}
 
 	g.LimitPrintCount(*maxCount, *maxCountPerFile)
 
-	for _, fileid := range post {
-		name := ix.Name(fileid)
-		g.File(name)
-		// short circuit here too
-		if g.Done {
-			break
-		}
-	}
+	g.Files(names, *workersFlag)
 
 	matches = g.Match
 }
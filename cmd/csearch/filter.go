@@ -0,0 +1,127 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/junkblocker/codesearch/glob"
+	"github.com/junkblocker/codesearch/regexp"
+)
+
+// A listFlag is a flag.Value collecting the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// A nameFilter selects the files to search by name,
+// as given by the -f, -exclude-f and -g flags.
+type nameFilter struct {
+	include     *regexp.Regexp   // -f
+	exclude     []*regexp.Regexp // -exclude-f
+	globs       []string         // -g without !
+	excludeGlob []string         // -g with !, without the !
+}
+
+// newNameFilter returns the filter for the given flag values.
+func newNameFilter(include string, exclude, globs []string) (*nameFilter, error) {
+	nf := new(nameFilter)
+	if include != "" {
+		re, err := regexp.Compile(include)
+		if err != nil {
+			return nil, err
+		}
+		nf.include = re
+	}
+	for _, expr := range exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		nf.exclude = append(nf.exclude, re)
+	}
+	for _, g := range globs {
+		neg := strings.HasPrefix(g, "!")
+		if neg {
+			g = g[1:]
+		}
+		if !glob.Valid(g) {
+			return nil, fmt.Errorf("bad glob: %s", g)
+		}
+		if neg {
+			nf.excludeGlob = append(nf.excludeGlob, g)
+		} else {
+			nf.globs = append(nf.globs, g)
+		}
+	}
+	return nf, nil
+}
+
+// empty reports whether nf selects every file.
+func (nf *nameFilter) empty() bool {
+	return nf.include == nil && len(nf.exclude) == 0 && len(nf.globs) == 0 && len(nf.excludeGlob) == 0
+}
+
+// match reports whether the file with the given name is to be searched:
+// whether it matches -f and one of the -g globs, if any, and no
+// -exclude-f regexp or negated -g glob.
+func (nf *nameFilter) match(name string) bool {
+	if nf.include != nil && nf.include.MatchString(name, true, true) < 0 {
+		return false
+	}
+	for _, re := range nf.exclude {
+		if re.MatchString(name, true, true) >= 0 {
+			return false
+		}
+	}
+	name = filepath.ToSlash(name)
+	if len(nf.globs) > 0 {
+		ok := false
+		for _, g := range nf.globs {
+			if globMatch(g, name) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, g := range nf.excludeGlob {
+		if globMatch(g, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch reports whether name matches the glob pattern.  A pattern
+// without a slash is matched against the last element of name, and
+// one with a slash against any trailing sequence of its elements,
+// so that cmd/*.go matches /src/cmd/main.go.
+func globMatch(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := glob.Match(pattern, name[strings.LastIndex(name, "/")+1:])
+		return ok
+	}
+	for {
+		if ok, _ := glob.Match(pattern, name); ok {
+			return true
+		}
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+var globMatchTests = []struct {
+	pattern string
+	name    string
+	ok      bool
+}{
+	{"*.go", "/src/main.go", true},
+	{"*.go", "/src/main.go/x.c", false},
+	{"*.go", "/src/go", false},
+	{"*_test.go", "/src/x_test.go", true},
+	{"cmd/*.go", "/src/cmd/main.go", true},
+	{"cmd/*.go", "/src/cmd/csearch/main.go", false},
+	{"cmd/*.go", "/src/xcmd/main.go", false},
+	{"cmd/**/*.go", "/src/cmd/main.go", true},
+	{"cmd/**/*.go", "/src/cmd/csearch/main.go", true},
+	{"cmd/**/*.go", "/src/cmd/csearch/main.c", false},
+	{"src/cmd/*.go", "/src/cmd/main.go", true},
+	{"/src/cmd/*.go", "/src/cmd/main.go", true},
+	{"/cmd/*.go", "/src/cmd/main.go", false},
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range globMatchTests {
+		if ok := globMatch(tt.pattern, tt.name); ok != tt.ok {
+			t.Errorf("globMatch(%#q, %#q) = %v, want %v", tt.pattern, tt.name, ok, tt.ok)
+		}
+	}
+}
+
+var nameFilterTests = []struct {
+	include string
+	exclude []string
+	globs   []string
+	name    string
+	ok      bool
+}{
+	{"", nil, nil, "/src/a.c", true},
+	{"", nil, []string{"*.go"}, "/src/a.go", true},
+	{"", nil, []string{"*.go"}, "/src/a.c", false},
+	{"", nil, []string{"*.go", "*.c"}, "/src/a.c", true},
+	{"", nil, []string{"!*_test.go"}, "/src/a.go", true},
+	{"", nil, []string{"!*_test.go"}, "/src/a_test.go", false},
+	{"", nil, []string{"*.go", "!*_test.go"}, "/src/a_test.go", false},
+	{"", nil, []string{"!*_test.go", "*.go"}, "/src/a_test.go", false},
+	{"", nil, []string{"cmd/**/*.go"}, "/src/cmd/csearch/csearch.go", true},
+	{"", nil, []string{"cmd/**/*.go"}, "/src/index/read.go", false},
+	{"/cmd/", nil, nil, "/src/cmd/csearch/csearch.go", true},
+	{"/cmd/", nil, nil, "/src/index/read.go", false},
+	{"/cmd/", []string{"csearch"}, nil, "/src/cmd/csearch/csearch.go", false},
+	{"/cmd/", []string{"csearch"}, nil, "/src/cmd/cindex/cindex.go", true},
+	{"", []string{`_test\.go$`}, []string{"*.go"}, "/src/a_test.go", false},
+	{"", []string{`_test\.go$`}, []string{"*.go"}, "/src/a.go", true},
+	{`\.go$`, nil, []string{"!cmd/**"}, "/src/cmd/cindex/cindex.go", false},
+	{`\.go$`, nil, []string{"!cmd/**"}, "/src/index/read.go", true},
+	{`\.go$`, nil, []string{"*.c"}, "/src/index/read.go", false},
+}
+
+func TestNameFilter(t *testing.T) {
+	for _, tt := range nameFilterTests {
+		nf, err := newNameFilter(tt.include, tt.exclude, tt.globs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := nf.match(tt.name); ok != tt.ok {
+			t.Errorf("-f %#q -exclude-f %q -g %q: match(%#q) = %v, want %v", tt.include, tt.exclude, tt.globs, tt.name, ok, tt.ok)
+		}
+	}
+	if nf, _ := newNameFilter("", nil, nil); !nf.empty() {
+		t.Errorf("filter without flags is not empty")
+	}
+	if _, err := newNameFilter("", nil, []string{"![x"}); err == nil {
+		t.Errorf("newNameFilter accepted the bad glob ![x")
+	}
+}
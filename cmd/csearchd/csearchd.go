@@ -0,0 +1,323 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/junkblocker/codesearch/index"
+	"github.com/junkblocker/codesearch/regexp"
+)
+
+var usageMessage = `usage: csearchd [options]
+
+csearchd serves searches of an index over HTTP, as a JSON API and
+as web pages.  It opens the index once, and opens it again whenever
+cindex replaces it.
+
+Options:
+
+  -http ADDR   serve HTTP on ADDR (Default: localhost:8080)
+  -indexpath FILE
+               use specified FILE as the index path. Overrides $CSEARCHINDEX.
+  -maxsearches N
+               run at most N searches at a time (Default: the number of CPUs);
+               other requests wait for their turn, up to the -timeout
+  -maxresults N
+               return at most N matching lines per search (Default: 1000)
+  -timeout DURATION
+               stop a search after DURATION, returning the lines found
+               so far (Default: 10s)
+  -verbose     print extra information
+
+A search is requested with
+
+	GET /search?q=REGEXP&f=PATHREGEXP&i=1&max=N&c=N
+
+where q is the regexp to search for, f restricts the search to files with
+names matching PATHREGEXP, i=1 makes it case-insensitive, max lowers the
+-maxresults limit and c asks for up to 10 lines of context around each
+matching line.  Only q is required.  The response is a JSON object
+
+	{"query":"REGEXP","candidates":3,"matches":[...],"truncated":true}
+
+where candidates is the number of files searched, matches lists the
+matching lines in the JSON format described by csearch -help, truncated
+is set if the search stopped at the max limit and timed_out if it stopped
+at the -timeout.  Bad requests get a 400 status and a JSON object with
+an "error" message, and requests that wait too long for their turn
+a 503 status.
+
+The same searches can be run from a browser, at the server's root
+page, which lists the matches by file.  Clicking on a match shows
+the file it is in, for the files in the index.
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	httpFlag    = flag.String("http", "localhost:8080", "serve HTTP on this address")
+	indexPath   = flag.String("indexpath", "", "specifies index path")
+	maxSearches = flag.Int("maxsearches", runtime.NumCPU(), "run at most this many searches at a time")
+	maxResults  = flag.Int("maxresults", 1000, "return at most this many matching lines per search")
+	timeout     = flag.Duration("timeout", 10*time.Second, "stop searches after this long")
+	verboseFlag = flag.Bool("verbose", false, "print extra information")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 || *maxSearches < 1 || *maxResults < 1 {
+		usage()
+	}
+
+	files := index.Files()
+	if *indexPath != "" {
+		files = filepath.SplitList(*indexPath)
+	}
+	if len(files) != 1 {
+		log.Fatalf("csearchd serves a single index, not %s", strings.Join(files, ", "))
+	}
+	file := files[0]
+	if index.IsSharded(file) {
+		log.Fatalf("csearchd serves a single index file, not the sharded index %s", file)
+	}
+	s := &server{
+		file:   file,
+		search: make(chan bool, *maxSearches),
+	}
+	s.release(s.acquire()) // open the index now to fail early
+
+	http.HandleFunc("/search", s.serveSearch)
+	http.HandleFunc("/file", s.serveFile)
+	http.HandleFunc("/", s.serveUI)
+	srv := &http.Server{
+		Addr:         *httpFlag,
+		ReadTimeout:  *timeout,
+		WriteTimeout: 3 * *timeout,
+	}
+	log.Printf("serving %s on %s", file, *httpFlag)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// A response is the JSON result of a search.
+type response struct {
+	Query      string          `json:"query"`
+	Candidates int             `json:"candidates"`
+	Matches    []*regexp.Match `json:"matches"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	TimedOut   bool            `json:"timed_out,omitempty"`
+}
+
+// An errorResponse is the JSON result of a failed request.
+type errorResponse struct {
+	Query string `json:"query,omitempty"`
+	Error string `json:"error"`
+}
+
+// A server handles search requests.
+type server struct {
+	file   string    // index file
+	search chan bool // holds a value per search running
+
+	mu     sync.Mutex
+	ix     *sharedIndex // current index
+	failed os.FileInfo  // index file that could not be opened, if any
+}
+
+// A request holds the parameters of a search.
+type request struct {
+	expr    string // q: regexp to search for
+	file    string // f: regexp the file names must match
+	fold    bool   // i: ignore case
+	max     int    // max: limit on matching lines
+	context int    // c: lines of context around matches
+}
+
+// maxContext is the most lines of context a search can ask for.
+const maxContext = 10
+
+// parseRequest returns the search parameters of r.
+func parseRequest(r *http.Request) (*request, error) {
+	req := &request{
+		expr: r.FormValue("q"),
+		file: r.FormValue("f"),
+		max:  *maxResults,
+	}
+	if req.expr == "" {
+		return req, errors.New("missing q parameter")
+	}
+	if v := r.FormValue("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return req, errors.New("bad max parameter: " + v)
+		}
+		if n < req.max {
+			req.max = n
+		}
+	}
+	if v := r.FormValue("i"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New("bad i parameter: " + v)
+		}
+		req.fold = b
+	}
+	if v := r.FormValue("c"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxContext {
+			return req, errors.New("bad c parameter: " + v)
+		}
+		req.context = n
+	}
+	return req, nil
+}
+
+// turn waits up to the -timeout for a turn to run a search, reporting
+// whether it got one.  If so, the caller must call endTurn when done.
+func (s *server) turn() bool {
+	select {
+	case s.search <- true:
+		return true
+	case <-time.After(*timeout):
+		return false
+	}
+}
+
+// endTurn ends a turn from turn.
+func (s *server) endTurn() {
+	<-s.search
+}
+
+// run runs req on the current index, waiting for a turn first.
+// It returns a nil response if the wait timed out.
+func (s *server) run(req *request, start time.Time) (*response, error) {
+	if !s.turn() {
+		return nil, nil
+	}
+	defer s.endTurn()
+
+	ix := s.acquire()
+	defer s.release(ix)
+	resp, err := search(ix.Index, req, start.Add(*timeout))
+	if err == nil && *verboseFlag {
+		log.Printf("%q: %d candidates, %d lines in %v", req.expr, resp.Candidates, len(resp.Matches), time.Since(start))
+	}
+	return resp, err
+}
+
+// serveSearch serves the JSON API.
+func (s *server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	req, err := parseRequest(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, req.expr, err.Error())
+		return
+	}
+	resp, err := s.run(req, start)
+	switch {
+	case err != nil:
+		fail(w, http.StatusBadRequest, req.expr, err.Error())
+	case resp == nil:
+		fail(w, http.StatusServiceUnavailable, req.expr, "too many searches")
+	default:
+		reply(w, http.StatusOK, resp)
+	}
+}
+
+// fail replies to the request for query q with an error message.
+func fail(w http.ResponseWriter, status int, q, msg string) {
+	reply(w, status, &errorResponse{Query: q, Error: msg})
+}
+
+// reply writes resp as the JSON response, with the given status.
+func reply(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil && *verboseFlag {
+		log.Print(err)
+	}
+}
+
+// compile returns the regexp to search for in req, as csearch
+// compiles it.
+func compile(req *request) (*regexp.Regexp, error) {
+	g := new(regexp.Grep)
+	return g.Compile([]string{req.expr}, req.fold)
+}
+
+// search searches the files in ix for req, as csearch does, returning
+// at most req.max matching lines.  It stops searching at the deadline,
+// returning the lines found until then.
+func search(ix *index.Index, req *request, deadline time.Time) (*response, error) {
+	s := &regexp.Searcher{
+		Index:   ix,
+		Context: req.context,
+		// One more line than wanted tells whether the search is truncated.
+		MaxMatches: req.max + 1,
+		FileError: func(name string, err error) error {
+			if *verboseFlag {
+				log.Printf("%q: %v", req.expr, err)
+			}
+			return nil
+		},
+	}
+	var err error
+	if s.Regexp, err = compile(req); err != nil {
+		return nil, err
+	}
+	if req.file != "" {
+		if s.Name, err = regexp.Compile(req.file); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	resp := &response{Query: req.expr, Matches: []*regexp.Match{}}
+	selected := 0
+	var last *regexp.Match // last selected line
+	err = s.Search(ctx, func(m *regexp.Match) error {
+		switch {
+		case !m.Context && selected == req.max:
+			resp.Truncated = true
+			return nil
+		case !m.Context:
+			selected++
+			last = m
+		case selected == req.max && (m.Path != last.Path || m.Line > last.Line+req.context):
+			// Context of the line beyond the limit only.
+			return nil
+		}
+		resp.Matches = append(resp.Matches, m)
+		return nil
+	})
+	resp.Candidates = s.Searched
+	switch err {
+	case nil:
+	case context.DeadlineExceeded:
+		resp.TimedOut = true
+	default:
+		return nil, err
+	}
+	return resp, nil
+}
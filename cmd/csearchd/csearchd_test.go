@@ -0,0 +1,223 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+var parseRequestTests = []struct {
+	query string
+	req   request
+	err   string
+}{
+	{"q=abc", request{expr: "abc", max: 1000}, ""},
+	{"q=abc&f=%5C.go%24&i=1&max=5&c=2", request{expr: "abc", file: `\.go$`, fold: true, max: 5, context: 2}, ""},
+	{"q=abc&i=false", request{expr: "abc", max: 1000}, ""},
+	{"q=abc&max=5000", request{expr: "abc", max: 1000}, ""},
+	{"q=abc&c=10", request{expr: "abc", max: 1000, context: 10}, ""},
+	{"", request{}, "missing q parameter"},
+	{"f=abc", request{}, "missing q parameter"},
+	{"q=abc&max=0", request{}, "bad max parameter: 0"},
+	{"q=abc&max=-1", request{}, "bad max parameter: -1"},
+	{"q=abc&max=x", request{}, "bad max parameter: x"},
+	{"q=abc&i=maybe", request{}, "bad i parameter: maybe"},
+	{"q=abc&c=-1", request{}, "bad c parameter: -1"},
+	{"q=abc&c=11", request{}, "bad c parameter: 11"},
+	{"q=abc&c=x", request{}, "bad c parameter: x"},
+}
+
+func TestParseRequest(t *testing.T) {
+	for _, tt := range parseRequestTests {
+		req, err := parseRequest(httptest.NewRequest("GET", "/search?"+tt.query, nil))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseRequest(%q) error = %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRequest(%q): %v", tt.query, err)
+			continue
+		}
+		if *req != tt.req {
+			t.Errorf("parseRequest(%q) = %+v, want %+v", tt.query, *req, tt.req)
+		}
+	}
+}
+
+// testServer returns a server of an index of files holding the given
+// contents, in a temporary directory that the caller must remove.
+func testServer(t *testing.T, files map[string]string) (*server, string) {
+	dir, err := ioutil.TempDir("", "csearchd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		file:   filepath.Join(dir, "index"),
+		search: make(chan bool, 1),
+	}
+	writeIndex(t, s.file, dir, files)
+	return s, dir
+}
+
+// writeIndex writes an index of files holding the given contents in dir
+// to a temporary file, and renames it to file, as cindex does.
+func writeIndex(t *testing.T, file, dir string, files map[string]string) {
+	var names []string
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	ix := index.Create(file + "~")
+	ix.AddPaths([]string{dir})
+	for _, name := range names {
+		ix.AddFile(name)
+	}
+	ix.Flush()
+	ix.Close()
+	if err := os.Rename(file+"~", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A testResponse is the part of a response that the tests check.
+type testResponse struct {
+	Matches []struct {
+		Text string `json:"text"`
+	} `json:"matches"`
+	Truncated bool `json:"truncated"`
+}
+
+// get serves a request for url from s, returning the status and
+// decoding the JSON response into v.
+func get(t *testing.T, s *server, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	s.serveSearch(w, httptest.NewRequest("GET", url, nil))
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return w.Code
+}
+
+func TestSearchTruncated(t *testing.T) {
+	s, dir := testServer(t, map[string]string{
+		"a": "hello one\nhello two\nother\nhello three\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		url       string
+		lines     []string
+		truncated bool
+	}{
+		{"/search?q=hello", []string{"hello one", "hello two", "hello three"}, false},
+		{"/search?q=hello&max=3", []string{"hello one", "hello two", "hello three"}, false},
+		{"/search?q=hello&max=2", []string{"hello one", "hello two"}, true},
+		{"/search?q=hello&max=2&c=1", []string{"hello one", "hello two", "other"}, true},
+		{"/search?q=hello&max=1&c=1", []string{"hello one"}, true},
+		{"/search?q=three&max=1&c=1", []string{"other", "hello three"}, false},
+	}
+	for _, tt := range tests {
+		var resp testResponse
+		if code := get(t, s, tt.url, &resp); code != http.StatusOK {
+			t.Errorf("GET %s: status %d", tt.url, code)
+			continue
+		}
+		var lines []string
+		for _, m := range resp.Matches {
+			lines = append(lines, m.Text)
+		}
+		if strings.Join(lines, "|") != strings.Join(tt.lines, "|") || resp.Truncated != tt.truncated {
+			t.Errorf("GET %s = %q, truncated %v, want %q, truncated %v", tt.url, lines, resp.Truncated, tt.lines, tt.truncated)
+		}
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	s, dir := testServer(t, map[string]string{"a": "hello\n"})
+	defer os.RemoveAll(dir)
+
+	var resp errorResponse
+	if code := get(t, s, "/search?q=a(", &resp); code != http.StatusBadRequest || resp.Query != "a(" || resp.Error == "" {
+		t.Errorf("GET bad regexp = %d %+v, want 400 with error", code, resp)
+	}
+	if code := get(t, s, "/search?q=a&c=20", &resp); code != http.StatusBadRequest || resp.Error != "bad c parameter: 20" {
+		t.Errorf("GET bad c = %d %+v, want 400 bad c parameter", code, resp)
+	}
+}
+
+func TestSearchLimiter(t *testing.T) {
+	s, dir := testServer(t, map[string]string{"a": "hello\n"})
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { *timeout = d }(*timeout)
+	*timeout = 10 * time.Millisecond
+
+	// Take the only turn, as a running search would.
+	if !s.turn() {
+		t.Fatal("no turn for the first search")
+	}
+	var resp errorResponse
+	if code := get(t, s, "/search?q=hello", &resp); code != http.StatusServiceUnavailable || resp.Error != "too many searches" {
+		t.Errorf("GET while busy = %d %+v, want 503 too many searches", code, resp)
+	}
+	s.endTurn()
+
+	var ok testResponse
+	if code := get(t, s, "/search?q=hello", &ok); code != http.StatusOK || len(ok.Matches) != 1 {
+		t.Errorf("GET when free = %d with %d matches, want 200 with 1", code, len(ok.Matches))
+	}
+}
+
+func TestSharedIndexReopen(t *testing.T) {
+	s, dir := testServer(t, map[string]string{"a": "hello\n"})
+	defer os.RemoveAll(dir)
+
+	old := s.acquire()
+	if again := s.acquire(); again != old {
+		t.Errorf("acquire reopened an unchanged index")
+	}
+	s.release(old)
+
+	writeIndex(t, s.file, dir, map[string]string{"a": "hello\n", "b": "hello again\n"})
+	ix := s.acquire()
+	if ix == old {
+		t.Fatalf("acquire did not open the replaced index")
+	}
+	if !old.replaced || old.refs != 1 {
+		t.Errorf("old index replaced %v with %d refs, want true with 1", old.replaced, old.refs)
+	}
+	if n := len(ix.PostingQuery(&index.Query{Op: index.QAll})); n != 2 {
+		t.Errorf("new index has %d files, want 2", n)
+	}
+	s.release(old)
+	s.release(ix)
+
+	// A corrupt replacement is not used.
+	if err := ioutil.WriteFile(s.file+"~", []byte("not an index"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(s.file+"~", s.file); err != nil {
+		t.Fatal(err)
+	}
+	if again := s.acquire(); again != ix {
+		t.Errorf("acquire replaced the index with a corrupt one")
+	}
+	s.release(ix)
+}
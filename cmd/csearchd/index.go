@@ -0,0 +1,72 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+// A sharedIndex is an open index shared by the searches using it.
+// Once it has been replaced by a newer index, it is closed when the
+// last of them is done.
+type sharedIndex struct {
+	*index.Index
+	info     os.FileInfo // the index file, when opened
+	refs     int         // number of searches using the index
+	replaced bool        // a newer index has been opened
+}
+
+// acquire returns the current index for a search, which must release
+// it when done.  When cindex has renamed a new index into place since
+// the last search, acquire opens it.  If the new index cannot be
+// opened, the searches go on using the old one.
+func (s *server) acquire() *sharedIndex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(s.file)
+	if err == nil && (s.ix == nil || !os.SameFile(fi, s.ix.info) && !os.SameFile(fi, s.failed)) {
+		var ix *index.Index
+		ix, err = index.OpenIndex(s.file)
+		if err == nil {
+			if s.ix != nil {
+				s.ix.replaced = true
+				s.closeIfUnused(s.ix)
+			}
+			s.ix = &sharedIndex{Index: ix, info: fi}
+			s.failed = nil
+			log.Printf("opened %s", s.file)
+		} else {
+			s.failed = fi
+		}
+	}
+	if err != nil {
+		if s.ix == nil {
+			log.Fatal(err)
+		}
+		log.Print(err)
+	}
+	s.ix.refs++
+	return s.ix
+}
+
+// release marks the end of a search using ix.
+func (s *server) release(ix *sharedIndex) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ix.refs--
+	s.closeIfUnused(ix)
+}
+
+// closeIfUnused closes ix if it has been replaced and
+// no search is using it.  s.mu must be held.
+func (s *server) closeIfUnused(ix *sharedIndex) {
+	if ix.replaced && ix.refs == 0 {
+		ix.Close()
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/junkblocker/codesearch/regexp"
+)
+
+// The web UI.  The root page has a form for a search, and lists
+// the lines found by it, grouped by file, with the matches highlighted
+// and a few lines of context.  Each line links to the file viewer,
+// /file?path=NAME, which shows a file in the index with an anchor
+// #Ln for each line n.  The pages are rendered on the server and
+// need no assets besides themselves.
+
+// uiContext is the number of lines of context shown around matches,
+// unless the request asks for another.
+const uiContext = 2
+
+// maxFileSize is the size of the largest file the viewer shows.
+const maxFileSize = 10 << 20
+
+// A uiFile is a file listed in the search results.
+type uiFile struct {
+	Path   string
+	URL    string
+	Groups [][]*uiLine // runs of consecutive lines
+}
+
+// A uiLine is a line shown on a page.
+type uiLine struct {
+	Line  int
+	URL   string
+	Match bool
+	Parts []uiPart
+}
+
+// A uiPart is a part of a line, highlighted if it is a match.
+type uiPart struct {
+	Text  string
+	Match bool
+}
+
+// split splits text into parts at the given matches.
+func split(text string, spans [][2]int) []uiPart {
+	var parts []uiPart
+	pos := 0
+	for _, m := range spans {
+		if m[0] < pos || m[1] > len(text) {
+			break
+		}
+		if m[0] > pos {
+			parts = append(parts, uiPart{Text: text[pos:m[0]]})
+		}
+		parts = append(parts, uiPart{Text: text[m[0]:m[1]], Match: true})
+		pos = m[1]
+	}
+	if pos < len(text) {
+		parts = append(parts, uiPart{Text: text[pos:]})
+	}
+	return parts
+}
+
+// fileURL returns the viewer URL of the named file, at the given line
+// if it is not 0, highlighting the matches of req if it is not nil.
+func fileURL(name string, req *request, line int) string {
+	v := url.Values{"path": {name}}
+	if req != nil {
+		v.Set("q", req.expr)
+		if req.fold {
+			v.Set("i", "1")
+		}
+	}
+	u := "/file?" + v.Encode()
+	if line > 0 {
+		u += "#L" + strconv.Itoa(line)
+	}
+	return u
+}
+
+// group groups the lines of resp by file.
+func group(resp *response, req *request) []*uiFile {
+	var files []*uiFile
+	var f *uiFile
+	last := 0
+	for _, l := range resp.Matches {
+		if f == nil || f.Path != l.Path {
+			f = &uiFile{Path: l.Path, URL: fileURL(l.Path, req, 0)}
+			files = append(files, f)
+			last = 0
+		}
+		if l.Line != last+1 || len(f.Groups) == 0 {
+			f.Groups = append(f.Groups, nil)
+		}
+		last = l.Line
+		g := &f.Groups[len(f.Groups)-1]
+		*g = append(*g, &uiLine{
+			Line:  l.Line,
+			URL:   fileURL(l.Path, req, l.Line),
+			Match: !l.Context,
+			Parts: split(string(l.Text), l.Spans),
+		})
+	}
+	return files
+}
+
+// A searchPage is the data for the search page.
+type searchPage struct {
+	Query     string
+	File      string
+	Fold      bool
+	Error     string
+	Searched  bool
+	Resp      *response
+	Files     []*uiFile
+	Elapsed   time.Duration
+	IndexFile string
+}
+
+// serveUI serves the search page.
+func (s *server) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	start := time.Now()
+	page := &searchPage{
+		Query:     r.FormValue("q"),
+		File:      r.FormValue("f"),
+		IndexFile: s.file,
+	}
+	status := http.StatusOK
+	if page.Query != "" {
+		page.Searched = true
+		if r.FormValue("c") == "" {
+			r.Form.Set("c", strconv.Itoa(uiContext))
+		}
+		req, err := parseRequest(r)
+		page.Fold = req.fold
+		var resp *response
+		if err == nil {
+			resp, err = s.run(req, start)
+		}
+		switch {
+		case err != nil:
+			status = http.StatusBadRequest
+			page.Error = err.Error()
+		case resp == nil:
+			status = http.StatusServiceUnavailable
+			page.Error = "too many searches, try again later"
+		default:
+			page.Resp = resp
+			page.Files = group(resp, req)
+		}
+	}
+	page.Elapsed = time.Since(start)
+	render(w, status, searchTemplate, page)
+}
+
+// A filePage is the data for the file viewer.
+type filePage struct {
+	Path  string
+	Query string
+	Fold  bool
+	Lines []*uiLine
+}
+
+// serveFile serves the file viewer.  Highlighting the matches takes
+// a turn, as a search does, and stops at the -timeout.
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name := r.FormValue("path")
+	ix := s.acquire()
+	_, ok := ix.Lookup(name)
+	s.release(ix)
+	if name == "" || !ok {
+		http.Error(w, "file not in the index", http.StatusNotFound)
+		return
+	}
+	if !s.turn() {
+		http.Error(w, "too many searches, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.endTurn()
+	data, err := readFile(name)
+	switch {
+	case err == errTooLarge:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	deadline := start.Add(*timeout)
+
+	page := &filePage{Path: name}
+	var re *regexp.Regexp
+	if q := r.FormValue("q"); q != "" {
+		req := &request{expr: q}
+		req.fold, _ = strconv.ParseBool(r.FormValue("i"))
+		if re, err = compile(req); err != nil {
+			re = nil
+		}
+		page.Query = q
+		page.Fold = req.fold
+	}
+	lines := bytes.SplitAfter(data, nl)
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		eol := bytes.HasSuffix(line, nl)
+		text := bytes.TrimSuffix(line, nl)
+		l := &uiLine{Line: i + 1}
+		var spans [][2]int
+		if re != nil && time.Now().After(deadline) {
+			re = nil
+		}
+		if re != nil {
+			for _, m := range re.LineMatches(text, i == 0, !eol) {
+				if m[0] < m[1] {
+					spans = append(spans, m)
+				}
+			}
+		}
+		l.Match = len(spans) > 0
+		l.Parts = split(string(text), spans)
+		page.Lines = append(page.Lines, l)
+	}
+	render(w, http.StatusOK, fileTemplate, page)
+}
+
+var nl = []byte{'\n'}
+
+var errTooLarge = errors.New("file too large")
+
+// readFile returns the contents of the named file, or errTooLarge
+// if it is larger than maxFileSize, without reading more than that.
+func readFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxFileSize {
+		return nil, errTooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxFileSize+1))
+	if len(data) > maxFileSize {
+		return nil, errTooLarge
+	}
+	return data, err
+}
+
+// render writes the page rendered by t with the given status.
+func render(w http.ResponseWriter, status int, t *template.Template, page interface{}) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, page); err != nil {
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+var (
+	searchTemplate = template.Must(template.Must(template.New("style").Parse(styleHTML)).New("search").Parse(searchHTML))
+	fileTemplate   = template.Must(template.Must(template.New("style").Parse(styleHTML)).New("file").Parse(fileHTML))
+)
+
+const styleHTML = `<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+form { margin-bottom: 1em; }
+input[type=text] { font-family: monospace; }
+.error { color: #c00; }
+.info { color: #666; font-size: small; }
+.file { margin-top: 1.5em; font-weight: bold; }
+.file a { color: #5a2a82; text-decoration: none; }
+pre { margin: 0.3em 0 0.6em 0; padding: 0.2em 0; background: #f8f8f8; border-left: 3px solid #ddd; }
+pre a.n { display: inline-block; width: 5em; padding-right: 1em; text-align: right; color: #393; text-decoration: none; }
+pre .m { background: #fe6; }
+pre .sel { font-weight: bold; }
+pre :target { background: #fdd; }
+</style>`
+
+const searchHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Query}}{{.Query}} - {{end}}Code Search</title>
+{{template "style"}}
+</head>
+<body>
+<form action="/" method="get">
+<input type="text" name="q" value="{{.Query}}" size="50" placeholder="regexp" autofocus>
+<input type="text" name="f" value="{{.File}}" size="30" placeholder="file name regexp">
+<label><input type="checkbox" name="i" value="1"{{if .Fold}} checked{{end}}> ignore case</label>
+<input type="submit" value="Search">
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{with .Resp}}
+<p class="info">{{len .Matches}} lines from {{.Candidates}} files in {{$.Elapsed}}{{if .Truncated}}; more lines were found but not shown{{end}}{{if .TimedOut}}; the search timed out before it was done{{end}}</p>
+{{end}}
+{{range .Files}}
+<div class="file"><a href="{{.URL}}">{{.Path}}</a></div>
+{{range .Groups}}<pre>{{range .}}<a class="n" href="{{.URL}}">{{.Line}}</a><span{{if .Match}} class="sel"{{end}}>{{range .Parts}}{{if .Match}}<span class="m">{{.Text}}</span>{{else}}{{.Text}}{{end}}{{end}}</span>
+{{end}}</pre>{{end}}
+{{else}}{{if and .Searched .Resp}}<p>No matches.</p>{{end}}{{end}}
+{{if not .Searched}}<p class="info">Searching {{.IndexFile}}</p>{{end}}
+</body>
+</html>
+`
+
+const fileHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Path}} - Code Search</title>
+{{template "style"}}
+</head>
+<body>
+<form action="/" method="get">
+<input type="text" name="q" value="{{.Query}}" size="50" placeholder="regexp">
+<label><input type="checkbox" name="i" value="1"{{if .Fold}} checked{{end}}> ignore case</label>
+<input type="submit" value="Search">
+</form>
+<div class="file">{{.Path}}</div>
+<pre>{{range .Lines}}<span id="L{{.Line}}"><a class="n" href="#L{{.Line}}">{{.Line}}</a><span{{if .Match}} class="sel"{{end}}>{{range .Parts}}{{if .Match}}<span class="m">{{.Text}}</span>{{else}}{{.Text}}{{end}}{{end}}</span></span>
+{{end}}</pre>
+</body>
+</html>
+`
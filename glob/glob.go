@@ -0,0 +1,84 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package glob implements shell-style pattern matching of slash-separated
+// paths, extended with ** to match any number of path elements.
+package glob
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether name matches the shell pattern.
+// The pattern syntax is that of path.Match, applied element by element,
+// with [!...] accepted as a synonym for [^...].
+// A ** as a whole path element matches zero or more elements,
+// except at the end of the pattern, where it matches one or more.
+// For example, a/**/b matches a/b and a/x/y/b,
+// and a/** matches everything inside a but not a itself.
+//
+// The only possible returned error is path.ErrBadPattern,
+// when pattern is malformed.
+func Match(pattern, name string) (bool, error) {
+	return match(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// Valid reports whether pattern is well-formed.
+func Valid(pattern string) bool {
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(fixClass(elem), ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func match(pat, name []string) (bool, error) {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				return len(name) > 0, nil
+			}
+			for i := 0; i <= len(name); i++ {
+				if ok, err := match(pat, name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(fixClass(pat[0]), name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pat = pat[1:]
+		name = name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// fixClass rewrites the shell negated character class [!...]
+// into the [^...] form understood by path.Match.
+func fixClass(elem string) string {
+	if !strings.Contains(elem, "[!") {
+		return elem
+	}
+	b := []byte(elem)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '[':
+			if i+1 < len(b) && b[i+1] == '!' {
+				b[i+1] = '^'
+			}
+		}
+	}
+	return string(b)
+}
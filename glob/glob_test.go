@@ -0,0 +1,63 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package glob
+
+import "testing"
+
+var matchTests = []struct {
+	pattern string
+	name    string
+	match   bool
+}{
+	{"*.go", "x.go", true},
+	{"*.go", "a/x.go", false},
+	{"a/*.go", "a/x.go", true},
+	{"a/*/c", "a/b/c", true},
+	{"a/*/c", "a/b/b/c", false},
+	{"a/?", "a/b", true},
+	{"a/[bc]", "a/c", true},
+	{"a/[!bc]", "a/c", false},
+	{"**/x.go", "x.go", true},
+	{"**/x.go", "a/b/x.go", true},
+	{"**/testdata", "third_party/a/testdata", true},
+	{"third_party/**/testdata", "third_party/testdata", true},
+	{"third_party/**/testdata", "third_party/a/b/testdata", true},
+	{"third_party/**/testdata", "other/a/testdata", false},
+	{"third_party/**/testdata", "third_party/a/testdata/x", false},
+	{"web/**/*.min.js", "web/x.min.js", true},
+	{"web/**/*.min.js", "web/a/x.min.js", true},
+	{"web/**/*.min.js", "lib/x.min.js", false},
+	{"a/**", "a", false},
+	{"a/**", "a/b", true},
+	{"a/**", "a/b/c", true},
+	{"**", "a/b", true},
+	{"a/**/**/b", "a/b", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		ok, err := Match(tt.pattern, tt.name)
+		if err != nil {
+			t.Errorf("Match(%q, %q): %v", tt.pattern, tt.name, err)
+			continue
+		}
+		if ok != tt.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, ok, tt.match)
+		}
+	}
+}
+
+func TestBadPattern(t *testing.T) {
+	if _, err := Match("a/[", "a/b"); err == nil {
+		t.Errorf("Match(a/[) succeeded")
+	}
+	if Valid("a/[") {
+		t.Errorf("Valid(a/[) = true")
+	}
+	if !Valid("a/**/[bc]") {
+		t.Errorf("Valid(a/**/[bc]) = false")
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2013 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "os"
+
+// inode returns 0: Windows file status carries no inode number.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
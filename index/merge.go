@@ -10,11 +10,11 @@ package index
 //
 // To merge two indexes A and B (newer) into a combined index C:
 //
-// Load the path list from B and determine for each path the docid ranges
-// that it will replace in A.
+// Load the path list from B.  Any file in A under one of those paths
+// is replaced by B's version, if any.
 //
 // Read A's and B's name lists together, merging them into C's name list.
-// Discard the identified ranges from A during the merge.  Also during the merge,
+// Discard the replaced files from A during the merge.  Also during the merge,
 // record the mapping from A's docids to C's docids, and also the mapping from
 // B's docids to C's docids.  Both mappings can be summarized in a table like
 //
@@ -35,6 +35,7 @@ package index
 import (
 	"encoding/binary"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -52,7 +53,25 @@ type postIndex struct {
 // Merge creates a new index in the file dst that corresponds to merging
 // the two indices src1 and src2.  If both src1 and src2 claim responsibility
 // for a path, src2 is assumed to be newer and is given preference.
+// The new index is written in the newer of the format versions of src1
+// and src2, so that merging never loses the ability to grow past 4 GB.
 func Merge(dst, src1, src2 string) {
+	Update(dst, src1, src2, nil)
+}
+
+// Update is like Merge, except that the files in src1 whose IDs are
+// listed in keep are carried over into dst even if src2 claims
+// responsibility for their paths.  cindex uses it to reuse the posting
+// lists of files that have not changed since src1 was written.
+// The keep list must be sorted.
+func Update(dst, src1, src2 string, keep []uint32) {
+	UpdateVersion(dst, src1, src2, keep, 0)
+}
+
+// UpdateVersion is like Update, except that dst is written in the given
+// format version.  A version of 0 means the newer of those of src1 and
+// src2, as in Update.
+func UpdateVersion(dst, src1, src2 string, keep []uint32, version int) {
 	ix1 := Open(src1)
 	defer ix1.Close()
 	ix2 := Open(src2)
@@ -61,58 +80,43 @@ func Merge(dst, src1, src2 string) {
 	paths2 := ix2.Paths()
 
 	// Build docid maps.
+	// Both name lists are sorted, so walk them in step, dropping the
+	// files of ix1 that ix2 takes responsibility for.
 	var i1, i2, new uint32
 	var map1, map2 []idrange
-	for _, path := range paths2 {
-		// Determine range shadowed by this path.
-		old := i1
-		for i1 < uint32(ix1.numName) && ix1.Name(i1) < path {
-			i1++
-		}
-		lo := i1
-		limit := path[:len(path)-1] + string(path[len(path)-1]+1)
-		for i1 < uint32(ix1.numName) && ix1.Name(i1) < limit {
-			i1++
-		}
-		hi := i1
-
-		// Record range before the shadow.
-		if old < lo {
-			map1 = append(map1, idrange{old, lo, new})
-			new += lo - old
-		}
-
-		// Determine range defined by this path.
-		// Because we are iterating over the ix2 paths,
-		// there can't be gaps, so it must start at i2.
-		if i2 < uint32(ix2.numName) && ix2.Name(i2) < path {
-			panic("merge: inconsistent index")
-		}
-		lo = i2
-		for i2 < uint32(ix2.numName) && ix2.Name(i2) < limit {
-			i2++
-		}
-		hi = i2
-		if lo < hi {
-			map2 = append(map2, idrange{lo, hi, new})
-			new += hi - lo
+	n1 := uint32(ix1.numName)
+	n2 := uint32(ix2.numName)
+	shadow := newPathSet(paths2)
+	for i1 < n1 || i2 < n2 {
+		if i1 < n1 {
+			for len(keep) > 0 && keep[0] < i1 {
+				keep = keep[1:]
+			}
+			name1 := ix1.Name(i1)
+			kept := len(keep) > 0 && keep[0] == i1
+			if !kept && shadow.covers(name1) {
+				i1++
+				continue
+			}
+			if i2 >= n2 || name1 < ix2.Name(i2) {
+				map1 = appendRange(map1, i1, new)
+				i1++
+				new++
+				continue
+			}
+			if name1 == ix2.Name(i2) {
+				// ix2 has a newer copy of the file.
+				i1++
+				continue
+			}
 		}
+		map2 = appendRange(map2, i2, new)
+		i2++
+		new++
 	}
 
-	if i1 < uint32(ix1.numName) {
-		map1 = append(map1, idrange{i1, uint32(ix1.numName), new})
-		new += uint32(ix1.numName) - i1
-	}
-	if i2 < uint32(ix2.numName) {
-		panic("merge: inconsistent index")
-	}
-	numName := new
-
-	ix3 := bufCreate(dst)
-	ix3.writeString(magic)
-
 	// Merged list of paths.
-	pathData := ix3.offset()
+	var paths []string
 	mi1 := 0
 	mi2 := 0
 	last := "\x00" // not a prefix of anything
@@ -129,6 +133,64 @@ func Merge(dst, src1, src2 string) {
 			continue
 		}
 		last = p
+		paths = append(paths, p)
+	}
+
+	if version == 0 {
+		version = ix1.version
+		if ix2.version > version {
+			version = ix2.version
+		}
+	}
+	writeMerged(dst, version, paths, ix1, map1, ix2, map2, new)
+}
+
+// Remove creates a new index in the file dst that corresponds to the
+// index src with the given paths removed.  The paths are dropped from
+// the path list, and every file in the trees rooted at them is dropped
+// from the name and posting lists.  The new index is written in the
+// same format version as src.
+func Remove(dst, src string, paths []string) {
+	ix := Open(src)
+	defer ix.Close()
+
+	drop := newPathSet(paths)
+	var keepPaths []string
+	for _, p := range ix.Paths() {
+		if !drop.covers(p) {
+			keepPaths = append(keepPaths, p)
+		}
+	}
+
+	// Build docid map.
+	var m []idrange
+	var new uint32
+	for i := uint32(0); i < uint32(ix.numName); i++ {
+		if !drop.covers(ix.Name(i)) {
+			m = appendRange(m, i, new)
+			new++
+		}
+	}
+
+	writeMerged(dst, ix.version, keepPaths, ix, m, nil, nil, new)
+}
+
+// writeMerged writes to dst an index in the given format version with
+// the given paths and numName files, taken from ix1 and ix2 according to
+// the docid maps map1 and map2.  ix2 may be nil if map2 is empty.
+// It exits the program with an error message if it cannot write dst.
+func writeMerged(dst string, version int, paths []string, ix1 *Index, map1 []idrange, ix2 *Index, map2 []idrange, numName uint32) {
+	defer exitOnWriteError()
+	ix3 := bufCreate(dst)
+	if version >= 2 {
+		ix3.writeString(magic2)
+	} else {
+		ix3.writeString(magic)
+	}
+
+	// List of paths.
+	pathData := ix3.offset()
+	for _, p := range paths {
 		ix3.writeString(p)
 		ix3.writeString("\x00")
 	}
@@ -137,25 +199,28 @@ func Merge(dst, src1, src2 string) {
 	// Merged list of names.
 	nameData := ix3.offset()
 	nameIndexFile := bufCreate("")
-	new = 0
-	mi1 = 0
-	mi2 = 0
+	infoFile := bufCreate("")
+	new := uint32(0)
+	mi1 := 0
+	mi2 := 0
 	for new < numName {
 		if mi1 < len(map1) && map1[mi1].new == new {
 			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
 				name := ix1.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeOffset(ix3.offset()-nameData, version)
 				ix3.writeString(name)
 				ix3.writeString("\x00")
+				infoFile.writeFileInfo(ix1.FileInfo(i))
 				new++
 			}
 			mi1++
 		} else if mi2 < len(map2) && map2[mi2].new == new {
 			for i := map2[mi2].lo; i < map2[mi2].hi; i++ {
 				name := ix2.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeOffset(ix3.offset()-nameData, version)
 				ix3.writeString(name)
 				ix3.writeString("\x00")
+				infoFile.writeFileInfo(ix2.FileInfo(i))
 				new++
 			}
 			mi2++
@@ -163,10 +228,10 @@ func Merge(dst, src1, src2 string) {
 			panic("merge: inconsistent index")
 		}
 	}
-	if new*4 != nameIndexFile.offset() {
+	if uint64(new)*offsetSize(version) != nameIndexFile.offset() {
 		panic("merge: inconsistent index")
 	}
-	nameIndexFile.writeUint32(ix3.offset())
+	nameIndexFile.writeOffset(ix3.offset(), version)
 
 	// Merged list of posting lists.
 	postData := ix3.offset()
@@ -175,7 +240,7 @@ func Merge(dst, src1, src2 string) {
 	var w postDataWriter
 	r1.init(ix1, map1)
 	r2.init(ix2, map2)
-	w.init(ix3)
+	w.init(ix3, version)
 	for {
 		if r1.trigram < r2.trigram {
 			w.trigram(r1.trigram)
@@ -223,17 +288,68 @@ func Merge(dst, src1, src2 string) {
 	postIndex := ix3.offset()
 	copyFile(ix3, w.postIndexFile)
 
-	ix3.writeUint32(pathData)
-	ix3.writeUint32(nameData)
-	ix3.writeUint32(postData)
-	ix3.writeUint32(nameIndex)
-	ix3.writeUint32(postIndex)
-	ix3.writeString(trailerMagic)
+	// File info, in version 2 only.
+	trailer := []uint64{pathData, nameData, postData, nameIndex, postIndex}
+	if version >= 2 {
+		trailer = append(trailer, ix3.offset())
+		copyFile(ix3, infoFile)
+	}
+
+	for _, off := range trailer {
+		ix3.writeOffset(off, version)
+	}
+	if version >= 2 {
+		ix3.writeString(infoTrailerMagic)
+	} else {
+		ix3.writeString(trailerMagic)
+	}
 	ix3.flush()
 	ix3.finish().Close()
 
 	os.Remove(nameIndexFile.name)
 	os.Remove(w.postIndexFile.name)
+	os.Remove(infoFile.name)
+}
+
+// appendRange records in m that id maps to new,
+// extending the last range in m when possible.
+func appendRange(m []idrange, id, new uint32) []idrange {
+	if n := len(m); n > 0 && m[n-1].hi == id && m[n-1].new+id-m[n-1].lo == new {
+		m[n-1].hi++
+		return m
+	}
+	return append(m, idrange{id, id + 1, new})
+}
+
+// A pathSet is a set of indexed paths.
+type pathSet map[string]bool
+
+func newPathSet(paths []string) pathSet {
+	s := make(pathSet)
+	for _, p := range paths {
+		s[p] = true
+	}
+	return s
+}
+
+// covers reports whether name is one of the paths in s
+// or lies in a directory tree rooted at one of them.
+func (s pathSet) covers(name string) bool {
+	const seps = "/" + string(filepath.Separator)
+	for {
+		if s[name] {
+			return true
+		}
+		i := strings.LastIndexAny(name, seps)
+		if i < 0 {
+			return false
+		}
+		if i == 0 || name[i-1] == ':' {
+			// Reached a root like / or C:\.
+			return s[name[:i+1]]
+		}
+		name = name[:i]
+	}
 }
 
 type postMapReader struct {
@@ -242,7 +358,7 @@ type postMapReader struct {
 	triNum  uint32
 	trigram uint32
 	count   uint32
-	offset  uint32
+	offset  uint64
 	d       []byte
 	oldid   uint32
 	fileid  uint32
@@ -253,10 +369,16 @@ func (r *postMapReader) init(ix *Index, idmap []idrange) {
 	r.ix = ix
 	r.idmap = idmap
 	r.trigram = ^uint32(0)
-	r.load()
+	r.fileid = ^uint32(0)
+	if ix != nil {
+		r.load()
+	}
 }
 
 func (r *postMapReader) nextTrigram() {
+	if r.ix == nil {
+		return
+	}
 	r.triNum++
 	r.load()
 }
@@ -268,7 +390,7 @@ func (r *postMapReader) load() {
 		r.fileid = ^uint32(0)
 		return
 	}
-	r.trigram, r.count, r.offset = r.ix.listAt(r.triNum * postEntrySize)
+	r.trigram, r.count, r.offset = r.ix.listAt(uint64(r.triNum) * r.ix.postEntrySize)
 	if r.count == 0 {
 		r.fileid = ^uint32(0)
 		return
@@ -284,7 +406,7 @@ func (r *postMapReader) nextId() bool {
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
 		if n <= 0 || delta == 0 {
-			corrupt()
+			r.ix.corrupt()
 		}
 		r.d = r.d[n:]
 		r.oldid += delta
@@ -309,16 +431,19 @@ func (r *postMapReader) nextId() bool {
 type postDataWriter struct {
 	out           *bufWriter
 	postIndexFile *bufWriter
+	version       int
 	buf           [10]byte
-	base          uint32
-	count, offset uint32
+	base          uint64
+	offset        uint64
+	count         uint32
 	last          uint32
 	t             uint32
 }
 
-func (w *postDataWriter) init(out *bufWriter) {
+func (w *postDataWriter) init(out *bufWriter, version int) {
 	w.out = out
 	w.postIndexFile = bufCreate("")
+	w.version = version
 	w.base = out.offset()
 }
 
@@ -345,5 +470,5 @@ func (w *postDataWriter) endTrigram() {
 	w.out.writeUvarint(0)
 	w.postIndexFile.writeTrigram(w.t)
 	w.postIndexFile.writeUint32(w.count)
-	w.postIndexFile.writeUint32(w.offset - w.base)
+	w.postIndexFile.writeOffset(w.offset-w.base, w.version)
 }
@@ -9,6 +9,7 @@ package index
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -40,6 +41,15 @@ var mergeFiles2 = map[string]string{
 }
 
 func TestMerge(t *testing.T) {
+	testMerge(t, 1, 1)
+}
+
+func TestMergeVersion2(t *testing.T) {
+	testMerge(t, 2, 1)
+	testMerge(t, 1, 2)
+}
+
+func testMerge(t *testing.T, version1, version2 int) {
 	f1, _ := ioutil.TempFile("", "index-test")
 	f2, _ := ioutil.TempFile("", "index-test")
 	f3, _ := ioutil.TempFile("", "index-test")
@@ -51,8 +61,8 @@ func TestMerge(t *testing.T) {
 	out2 := f2.Name()
 	out3 := f3.Name()
 
-	buildIndex(t, out1, mergePaths1, mergeFiles1)
-	buildIndex(t, out2, mergePaths2, mergeFiles2)
+	buildIndexVersion(t, out1, mergePaths1, mergeFiles1, version1)
+	buildIndexVersion(t, out2, mergePaths2, mergeFiles2, version2)
 
 	Merge(out3, out1, out2)
 
@@ -84,6 +94,14 @@ func TestMerge(t *testing.T) {
 	checkFiles(ix2, "/b/www", "/b/xx", "/b/yy", "/cc")
 	checkFiles(ix3, "/a/x", "/a/y", "/b/www", "/b/xx", "/b/yy", "/c/ab", "/c/de", "/cc")
 
+	want := version1
+	if version2 > want {
+		want = version2
+	}
+	if v := ix3.Version(); v != want {
+		t.Errorf("ix3.Version() = %d, want %d", v, want)
+	}
+
 	check := func(ix *Index, trig string, l ...uint32) {
 		l1 := ix.PostingList(tri(trig[0], trig[1], trig[2]))
 		if !equalList(l1, l) {
@@ -102,3 +120,131 @@ func TestMerge(t *testing.T) {
 	check(ix3, "now", 3, 4, 6)
 	check(ix3, "pot", 4, 5, 7)
 }
+
+func TestUpdateVersion(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	buildIndexVersion(t, f1.Name(), mergePaths1, mergeFiles1, 2)
+	buildIndexVersion(t, f2.Name(), mergePaths2, mergeFiles2, 2)
+	UpdateVersion(f3.Name(), f1.Name(), f2.Name(), nil, 1)
+
+	ix := Open(f3.Name())
+	defer ix.Close()
+	if v := ix.Version(); v != 1 {
+		t.Errorf("Version() = %d, want 1", v)
+	}
+	if n := ix.Name(2); n != "/b/www" {
+		t.Errorf("Name(2) = %s, want /b/www", n)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+	out3 := f3.Name()
+
+	buildIndex(t, out1, mergePaths1, mergeFiles1)
+	buildIndex(t, out2, mergePaths2, mergeFiles2)
+
+	// Keep /b/xy (3) from the first index, and /b/xx (2),
+	// which the second index replaces anyway.
+	Update(out3, out1, out2, []uint32{2, 3})
+
+	ix3 := Open(out3)
+	defer ix3.Close()
+
+	want := []string{"/a/x", "/a/y", "/b/www", "/b/xx", "/b/xy", "/b/yy", "/c/ab", "/c/de", "/cc"}
+	for i, s := range want {
+		if n := ix3.Name(uint32(i)); n != s {
+			t.Errorf("Name(%d) = %s, want %s", i, n, s)
+		}
+	}
+	if ix3.numName != len(want) {
+		t.Errorf("numName = %d, want %d", ix3.numName, len(want))
+	}
+
+	check := func(trig string, l ...uint32) {
+		l1 := ix3.PostingList(tri(trig[0], trig[1], trig[2]))
+		if !equalList(l1, l) {
+			t.Errorf("PostingList(%s) = %v, want %v", trig, l1, l)
+		}
+	}
+	check("all", 4, 6)
+	check("now", 3, 5, 7)
+	check("wor", 0, 1, 2)
+}
+
+func TestRemove(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+
+	buildIndex(t, out1, mergePaths1, mergeFiles1)
+	Remove(out2, out1, []string{"/b", "/c/de"})
+
+	ix := Open(out2)
+	defer ix.Close()
+
+	if p := ix.Paths(); !reflect.DeepEqual(p, []string{"/a", "/c"}) {
+		t.Errorf("Paths() = %q, want [/a /c]", p)
+	}
+	want := []string{"/a/x", "/a/y", "/c/ab"}
+	for i, s := range want {
+		if n := ix.Name(uint32(i)); n != s {
+			t.Errorf("Name(%d) = %s, want %s", i, n, s)
+		}
+	}
+	if ix.numName != len(want) {
+		t.Errorf("numName = %d, want %d", ix.numName, len(want))
+	}
+
+	check := func(trig string, l ...uint32) {
+		l1 := ix.PostingList(tri(trig[0], trig[1], trig[2]))
+		if !equalList(l1, l) {
+			t.Errorf("PostingList(%s) = %v, want %v", trig, l1, l)
+		}
+	}
+	check("all", 2)
+	check("now")
+	check("wor", 0, 1)
+}
+
+func TestPathSetCovers(t *testing.T) {
+	s := newPathSet([]string{"/a/b", "/c"})
+	tests := []struct {
+		name  string
+		cover bool
+	}{
+		{"/a/b", true},
+		{"/a/b/c", true},
+		{"/a/bc", false},
+		{"/a/b.c", false},
+		{"/a", false},
+		{"/c/d/e", true},
+		{"/cc", false},
+	}
+	for _, tt := range tests {
+		if c := s.covers(tt.name); c != tt.cover {
+			t.Errorf("covers(%s) = %v, want %v", tt.name, c, tt.cover)
+		}
+	}
+	if !newPathSet([]string{"/"}).covers("/x/y") {
+		t.Errorf("/ does not cover /x/y")
+	}
+}
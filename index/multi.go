@@ -0,0 +1,109 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// A MultiIndex is a list of indexes searched as one.  When indexes
+// cover some of the same paths, the files there are looked up in the
+// most recently built of them only, as the others may be out of date.
+type MultiIndex struct {
+	Indexes []*Index // newest first
+	paths   []pathSet
+}
+
+// OpenMulti opens the index files, exiting the program with an error
+// message if one of them cannot be opened, as Open does.  A sharded
+// index, given by its directory, is opened as the list of its shards.
+func OpenMulti(files []string) *MultiIndex {
+	type built struct {
+		ix  *Index
+		mod int64
+	}
+	var list []built
+	for i := 0; i < len(files); i++ {
+		file := files[i]
+		if IsSharded(file) {
+			m, err := ReadManifest(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			files = append(files[:i+1:i+1], append(m.Files(), files[i+1:]...)...)
+			continue
+		}
+		ix := Open(file)
+		fi, err := ix.data.f.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+		list = append(list, built{ix, fi.ModTime().UnixNano()})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].mod > list[j].mod
+	})
+	m := new(MultiIndex)
+	for _, b := range list {
+		m.Indexes = append(m.Indexes, b.ix)
+		m.paths = append(m.paths, newPathSet(b.ix.Paths()))
+	}
+	return m
+}
+
+// Names returns the sorted names of the files that may match q: those
+// found by each index, except for the ones an index newer than it covers.
+// The indexes are queried in parallel.
+func (m *MultiIndex) Names(q *Query) []string {
+	post := make([][]uint32, len(m.Indexes))
+	if len(m.Indexes) == 1 {
+		post[0] = m.Indexes[0].PostingQuery(q)
+	} else {
+		var wg sync.WaitGroup
+		for i, ix := range m.Indexes {
+			wg.Add(1)
+			go func(i int, ix *Index) {
+				defer wg.Done()
+				post[i] = ix.PostingQuery(q)
+			}(i, ix)
+		}
+		wg.Wait()
+	}
+
+	var names []string
+	for i, ix := range m.Indexes {
+	Files:
+		for _, fileid := range post[i] {
+			name := ix.Name(fileid)
+			for _, newer := range m.paths[:i] {
+				if newer.covers(name) {
+					continue Files
+				}
+			}
+			names = append(names, name)
+		}
+	}
+	if len(m.Indexes) == 1 {
+		return names
+	}
+	sort.Strings(names)
+	out := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Close closes the indexes.
+func (m *MultiIndex) Close() {
+	for _, ix := range m.Indexes {
+		ix.Close()
+	}
+}
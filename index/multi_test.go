@@ -0,0 +1,75 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The older index covers both /a and /b,
+	// the newer one /b and /c, and is the one used for /b.
+	older := filepath.Join(dir, "older")
+	buildIndex(t, older, []string{"/a", "/b"}, map[string]string{
+		"/a/1": "Google Code Search",
+		"/b/1": "Google Code Search",
+		"/b/2": "Google Code Search",
+	})
+	newer := filepath.Join(dir, "newer")
+	buildIndex(t, newer, []string{"/b", "/c"}, map[string]string{
+		"/b/1": "Google Web Search",
+		"/b/2": "Google Code Project Hosting",
+		"/c/1": "Google Code Search",
+	})
+	now := time.Now()
+	os.Chtimes(older, now.Add(-time.Hour), now.Add(-time.Hour))
+	os.Chtimes(newer, now, now)
+
+	for _, files := range [][]string{{older, newer}, {newer, older}} {
+		ix := OpenMulti(files)
+		if ix.Indexes[0].data.f.Name() != newer {
+			t.Errorf("OpenMulti(%v): newest index is %s, want %s", files, ix.Indexes[0].data.f.Name(), newer)
+		}
+		q := &Query{Op: QAnd, Trigram: []string{"Cod"}}
+		want := []string{"/a/1", "/b/2", "/c/1"}
+		if names := ix.Names(q); !reflect.DeepEqual(names, want) {
+			t.Errorf("Names(%v) = %v, want %v", q, names, want)
+		}
+		q = &Query{Op: QAll}
+		want = []string{"/a/1", "/b/1", "/b/2", "/c/1"}
+		if names := ix.Names(q); !reflect.DeepEqual(names, want) {
+			t.Errorf("Names(%v) = %v, want %v", q, names, want)
+		}
+		ix.Close()
+	}
+}
+
+func TestFiles(t *testing.T) {
+	defer os.Setenv("CSEARCHINDEX", os.Getenv("CSEARCHINDEX"))
+	sep := string(filepath.ListSeparator)
+	os.Setenv("CSEARCHINDEX", "x"+sep+sep+"y")
+	if files := Files(); !reflect.DeepEqual(files, []string{"x", "y"}) {
+		t.Errorf("Files() = %v, want [x y]", files)
+	}
+	if file := File(); file != "x" {
+		t.Errorf("File() = %q, want x", file)
+	}
+	os.Setenv("CSEARCHINDEX", "")
+	if files := Files(); len(files) != 1 || filepath.Base(files[0]) != ".csearchindex" {
+		t.Errorf("Files() = %v, want [$HOME/.csearchindex]", files)
+	}
+}
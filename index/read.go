@@ -10,12 +10,13 @@ package index
 //
 // An index stored on disk has the format:
 //
-//	"csearch index 1\n"
+//	"csearch index 1\n" or "csearch index 2\n"
 //	list of paths
 //	list of names
 //	list of posting lists
 //	name index
 //	posting list index
+//	file info (version 2 only)
 //	trailer
 //
 // The list of paths is a sorted sequence of NUL-terminated file or directory names.
@@ -57,6 +58,17 @@ package index
 // of the possible trigrams are never seen, so omitting the missing
 // ones represents a significant storage savings.
 //
+// The file info is a sequence of fixed-size entries, one per name,
+// recording what the file looked like when it was indexed:
+//
+//	modification time [8]
+//	size [8]
+//	inode [8]
+//
+// The modification time is in nanoseconds since the Unix epoch.
+// An all-zero entry means nothing is known about the file.
+// cindex uses the file info to avoid rereading unchanged files.
+//
 // The trailer has the form:
 //
 //	offset of path list [4]
@@ -65,6 +77,14 @@ package index
 //	offset of name index [4]
 //	offset of posting list index [4]
 //	"\ncsearch trailr\n"
+//
+// Version 1 of the format, described above, limits the index to 4 GB.
+// Version 2, marked by the "csearch index 2\n" header, differs in that
+// every offset (in the name index, the posting list index and the
+// trailer) is 8 bytes instead of 4, and in having the file info, whose
+// offset follows that of the posting list index in the trailer, which
+// ends in "\ncsearch infotr\n" instead.  Version 1 indexes have no file
+// info, so that they stay readable by older versions of csearch.
 
 import (
 	"bytes"
@@ -74,51 +94,164 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"sync/atomic"
 )
 
 const (
-	magic        = "csearch index 1\n"
-	trailerMagic = "\ncsearch trailr\n"
+	magic            = "csearch index 1\n"
+	magic2           = "csearch index 2\n"
+	trailerMagic     = "\ncsearch trailr\n"
+	infoTrailerMagic = "\ncsearch infotr\n"
 )
 
 // An Index implements read-only access to a trigram index.
 type Index struct {
-	Verbose   bool
-	data      mmapData
-	pathData  uint32
-	nameData  uint32
-	postData  uint32
-	nameIndex uint32
-	postIndex uint32
-	numName   int
-	numPost   int
+	Verbose       bool
+	data          mmapData
+	version       int
+	offSize       uint64 // size of an offset: 4 in version 1, 8 in version 2
+	postEntrySize uint64
+	pathData      uint64
+	nameData      uint64
+	postData      uint64
+	nameIndex     uint64
+	postIndex     uint64
+	fileInfo      uint64 // 0 if the index has no file info
+	numName       int
+	numPost       int
+	exitOnCorrupt bool         // opened by Open: exit if the index turns out to be corrupt
+	err           atomic.Value // *CorruptError found by the methods, if any
 }
 
-const postEntrySize = 3 + 4 + 4
+// A CorruptError reports that an index file is corrupt.
+type CorruptError struct {
+	File string
+}
 
+func (e *CorruptError) Error() string {
+	return "corrupt index: " + e.File
+}
+
+const fileInfoSize = 8 + 8 + 8
+
+// offsetSize returns the size of an offset in the given format version.
+func offsetSize(version int) uint64 {
+	if version >= 2 {
+		return 8
+	}
+	return 4
+}
+
+// Open opens the index file, exiting the program with an error
+// message if it cannot be opened, or if it is or later turns out
+// to be corrupt.
 func Open(file string) *Index {
-	mm := mmap(file)
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
-		corrupt()
-	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: mm}
-	ix.pathData = ix.uint32(n)
-	ix.nameData = ix.uint32(n + 4)
-	ix.postData = ix.uint32(n + 8)
-	ix.nameIndex = ix.uint32(n + 12)
-	ix.postIndex = ix.uint32(n + 16)
-	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	ix, err := OpenIndex(file)
+	if err != nil {
+		if _, ok := err.(*CorruptError); ok {
+			log.Fatal("corrupt index: remove " + file)
+		}
+		log.Fatal(err)
+	}
+	ix.exitOnCorrupt = true
 	return ix
 }
 
+// OpenIndex opens the index file, returning an error if it cannot
+// be opened or is corrupt.  The index is not read in full, so later
+// calls of its methods may still find it corrupt.  They then return
+// what they can, such as an empty name or posting list, and Err
+// reports the corruption from then on.
+func OpenIndex(file string) (ix *Index, err error) {
+	mm, err := mmap(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(*CorruptError); !ok {
+				panic(e)
+			}
+			ix.Close()
+			ix, err = nil, e.(*CorruptError)
+		}
+	}()
+	ix = &Index{data: mm, version: 1}
+	if hasPrefix(mm.d, magic2) {
+		ix.version = 2
+	}
+	ix.offSize = offsetSize(ix.version)
+	ix.postEntrySize = 3 + 4 + ix.offSize
+
+	var n uint64 // offset of trailer
+	end := n     // end of posting list index
+	switch {
+	case hasSuffix(mm.d, infoTrailerMagic) && ix.version == 2:
+		if uint64(len(mm.d)) < 6*ix.offSize+uint64(len(infoTrailerMagic)) {
+			ix.corrupt()
+		}
+		n = uint64(len(mm.d)-len(infoTrailerMagic)) - 6*ix.offSize
+		ix.fileInfo = ix.offset(n + 5*ix.offSize)
+		end = ix.fileInfo
+	case hasSuffix(mm.d, trailerMagic) && ix.version == 1:
+		if len(mm.d) < 5*4+len(trailerMagic) {
+			ix.corrupt()
+		}
+		n = uint64(len(mm.d) - len(trailerMagic) - 5*4)
+		end = n
+	default:
+		ix.corrupt()
+	}
+	ix.pathData = ix.offset(n)
+	ix.nameData = ix.offset(n + ix.offSize)
+	ix.postData = ix.offset(n + 2*ix.offSize)
+	ix.nameIndex = ix.offset(n + 3*ix.offSize)
+	ix.postIndex = ix.offset(n + 4*ix.offSize)
+	ix.numName = int((ix.postIndex-ix.nameIndex)/ix.offSize) - 1
+	ix.numPost = int((end - ix.postIndex) / ix.postEntrySize)
+	return ix, nil
+}
+
+// Err returns the *CorruptError found by the methods of an index
+// opened by OpenIndex, or nil if they have found none.
+func (ix *Index) Err() error {
+	if e := ix.err.Load(); e != nil {
+		return e.(*CorruptError)
+	}
+	return nil
+}
+
+// check, deferred by the exported methods that read the index,
+// records the corruption found by them, as described for OpenIndex.
+func (ix *Index) check() {
+	if e := recover(); e != nil {
+		ce, ok := e.(*CorruptError)
+		if !ok {
+			panic(e)
+		}
+		ix.err.CompareAndSwap(nil, ce)
+	}
+}
+
+// Version returns the format version of the index: 1 or 2.
+func (ix *Index) Version() int {
+	return ix.version
+}
+
+func hasPrefix(d []byte, prefix string) bool {
+	return len(d) >= len(prefix) && string(d[:len(prefix)]) == prefix
+}
+
+func hasSuffix(d []byte, suffix string) bool {
+	return len(d) >= len(suffix) && string(d[len(d)-len(suffix):]) == suffix
+}
+
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
-func (ix *Index) slice(off uint32, n int) []byte {
+func (ix *Index) slice(off uint64, n int) []byte {
 	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
-		corrupt()
+	if uint64(o) != off || o < 0 || o > len(ix.data.d) || n >= 0 && o+n > len(ix.data.d) {
+		ix.corrupt()
 	}
 	if n < 0 {
 		return ix.data.d[o:]
@@ -127,21 +260,31 @@ func (ix *Index) slice(off uint32, n int) []byte {
 }
 
 // uint32 returns the uint32 value at the given offset in the index data.
-func (ix *Index) uint32(off uint32) uint32 {
+func (ix *Index) uint32(off uint64) uint32 {
 	return binary.BigEndian.Uint32(ix.slice(off, 4))
 }
 
+// offset returns the offset stored at the given offset in the index data.
+// Stored offsets are 4 bytes in version 1 indexes and 8 bytes in version 2.
+func (ix *Index) offset(off uint64) uint64 {
+	if ix.offSize == 8 {
+		return binary.BigEndian.Uint64(ix.slice(off, 8))
+	}
+	return uint64(ix.uint32(off))
+}
+
 // uvarint returns the varint value at the given offset in the index data.
-func (ix *Index) uvarint(off uint32) uint32 {
+func (ix *Index) uvarint(off uint64) uint32 {
 	v, n := binary.Uvarint(ix.slice(off, -1))
 	if n <= 0 {
-		corrupt()
+		ix.corrupt()
 	}
 	return uint32(v)
 }
 
 // Paths returns the list of indexed paths.
 func (ix *Index) Paths() []string {
+	defer ix.check()
 	off := ix.pathData
 	var x []string
 	for {
@@ -150,22 +293,23 @@ func (ix *Index) Paths() []string {
 			break
 		}
 		x = append(x, string(s))
-		off += uint32(len(s) + 1)
+		off += uint64(len(s) + 1)
 	}
 	return x
 }
 
 // NameBytes returns the name corresponding to the given fileid.
 func (ix *Index) NameBytes(fileid uint32) []byte {
-	off := ix.uint32(ix.nameIndex + 4*fileid)
+	defer ix.check()
+	off := ix.offset(ix.nameIndex + ix.offSize*uint64(fileid))
 	return ix.str(ix.nameData + off)
 }
 
-func (ix *Index) str(off uint32) []byte {
+func (ix *Index) str(off uint64) []byte {
 	str := ix.slice(off, -1)
 	i := bytes.IndexByte(str, '\x00')
 	if i < 0 {
-		corrupt()
+		ix.corrupt()
 	}
 	return str[:i]
 }
@@ -175,51 +319,105 @@ func (ix *Index) Name(fileid uint32) string {
 	return string(ix.NameBytes(fileid))
 }
 
+// Lookup returns the fileid of the file with the given name.
+// The boolean result reports whether the name is in the index at all.
+func (ix *Index) Lookup(name string) (uint32, bool) {
+	i := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= name
+	})
+	if i < ix.numName && string(ix.NameBytes(uint32(i))) == name {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// A FileInfo records the state of a file at the time it was indexed.
+// The zero FileInfo means that the state is not known.
+type FileInfo struct {
+	ModTime int64 // modification time, in nanoseconds since the Unix epoch
+	Size    int64
+	Inode   uint64
+}
+
+// NewFileInfo returns the FileInfo describing the file with the given status.
+func NewFileInfo(fi os.FileInfo) FileInfo {
+	return FileInfo{
+		ModTime: fi.ModTime().UnixNano(),
+		Size:    fi.Size(),
+		Inode:   inode(fi),
+	}
+}
+
+// FileInfo returns the recorded state of the file with the given fileid.
+// It returns the zero FileInfo if the index has no file info.
+func (ix *Index) FileInfo(fileid uint32) FileInfo {
+	defer ix.check()
+	if ix.fileInfo == 0 {
+		return FileInfo{}
+	}
+	d := ix.slice(ix.fileInfo+fileInfoSize*uint64(fileid), fileInfoSize)
+	return FileInfo{
+		ModTime: int64(binary.BigEndian.Uint64(d)),
+		Size:    int64(binary.BigEndian.Uint64(d[8:])),
+		Inode:   binary.BigEndian.Uint64(d[16:]),
+	}
+}
+
 // listAt returns the index list entry at the given offset.
-func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
-	d := ix.slice(ix.postIndex+off, postEntrySize)
+func (ix *Index) listAt(off uint64) (trigram, count uint32, offset uint64) {
+	d := ix.slice(ix.postIndex+off, int(ix.postEntrySize))
 	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
 	count = binary.BigEndian.Uint32(d[3:])
-	offset = binary.BigEndian.Uint32(d[3+4:])
+	offset = ix.entryOffset(d[3+4:])
 	return
 }
 
+// entryOffset decodes the offset field of a posting list index entry.
+func (ix *Index) entryOffset(d []byte) uint64 {
+	if ix.offSize == 8 {
+		return binary.BigEndian.Uint64(d)
+	}
+	return uint64(binary.BigEndian.Uint32(d))
+}
+
 func (ix *Index) dumpPosting() {
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
+	size := int(ix.postEntrySize)
+	d := ix.slice(ix.postIndex, size*ix.numPost)
 	for i := 0; i < ix.numPost; i++ {
-		j := i * postEntrySize
+		j := i * size
 		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
 		count := int(binary.BigEndian.Uint32(d[j+3:]))
-		offset := binary.BigEndian.Uint32(d[j+3+4:])
+		offset := ix.entryOffset(d[j+3+4:])
 		log.Printf("%#x: %d at %d", t, count, offset)
 	}
 }
 
-func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
+func (ix *Index) findList(trigram uint32) (count int, offset uint64) {
 	// binary search
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
+	size := int(ix.postEntrySize)
+	d := ix.slice(ix.postIndex, size*ix.numPost)
 	i := sort.Search(ix.numPost, func(i int) bool {
-		i *= postEntrySize
+		i *= size
 		t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
 		return t >= trigram
 	})
 	if i >= ix.numPost {
 		return 0, 0
 	}
-	i *= postEntrySize
+	i *= size
 	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
 	if t != trigram {
 		return 0, 0
 	}
 	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
+	offset = ix.entryOffset(d[i+3+4:])
 	return
 }
 
 type postReader struct {
 	ix       *Index
 	count    int
-	offset   uint32
+	offset   uint64
 	fileid   uint32
 	d        []byte
 	restrict []uint32
@@ -248,7 +446,7 @@ func (r *postReader) next() bool {
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
 		if n <= 0 || delta == 0 {
-			corrupt()
+			r.ix.corrupt()
 		}
 		r.d = r.d[n:]
 		r.fileid += delta
@@ -266,13 +464,14 @@ func (r *postReader) next() bool {
 	}
 	// list should end with terminating 0 delta
 	if r.d != nil && (len(r.d) == 0 || r.d[0] != 0) {
-		corrupt()
+		r.ix.corrupt()
 	}
 	r.fileid = ^uint32(0)
 	return false
 }
 
 func (ix *Index) PostingList(trigram uint32) []uint32 {
+	defer ix.check()
 	return ix.postingList(trigram, nil)
 }
 
@@ -287,6 +486,7 @@ func (ix *Index) postingList(trigram uint32, restrict []uint32) []uint32 {
 }
 
 func (ix *Index) PostingAnd(list []uint32, trigram uint32) []uint32 {
+	defer ix.check()
 	return ix.postingAnd(list, trigram, nil)
 }
 
@@ -309,6 +509,7 @@ func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []
 }
 
 func (ix *Index) PostingOr(list []uint32, trigram uint32) []uint32 {
+	defer ix.check()
 	return ix.postingOr(list, trigram, nil)
 }
 
@@ -333,6 +534,7 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []u
 }
 
 func (ix *Index) PostingQuery(q *Query) []uint32 {
+	defer ix.check()
 	return ix.postingQuery(q, nil)
 }
 
@@ -409,8 +611,15 @@ func mergeOr(l1, l2 []uint32) []uint32 {
 	return l
 }
 
-func corrupt() {
-	log.Fatal("corrupt index: remove " + File())
+// corrupt reports that the index is corrupt: it exits the program
+// if the index was opened by Open, and otherwise panics with
+// a *CorruptError, which the exported methods recover.
+func (ix *Index) corrupt() {
+	name := ix.data.f.Name()
+	if ix.exitOnCorrupt {
+		log.Fatal("corrupt index: remove " + name)
+	}
+	panic(&CorruptError{File: name})
 }
 
 // An mmapData is mmap'ed read-only data from a file.
@@ -421,16 +630,22 @@ type mmapData struct {
 }
 
 // mmap maps the given file into memory.
-func mmap(file string) mmapData {
+func mmap(file string) (mmapData, error) {
 	f, err := os.Open(file)
 	if err != nil {
-		log.Fatal(err)
+		return mmapData{}, err
 	}
-	return mmapFile(f)
+	mm, err := mmapFile(f)
+	if err != nil {
+		f.Close()
+	}
+	return mm, err
 }
 
 func (ix Index) Close() {
-	unmmapFile(&ix.data)
+	if ix.data.d != nil {
+		unmmapFile(&ix.data)
+	}
 	ix.data.f.Close()
 }
 
@@ -444,12 +659,24 @@ func HomeDir() string {
 	return home
 }
 
-// File returns the name of the index file to use.
-// It is either $CSEARCHINDEX or $HOME/.csearchindex.
-func File() string {
-	f := os.Getenv("CSEARCHINDEX")
-	if f != "" {
-		return f
+// Files returns the names of the index files to search: the elements
+// of $CSEARCHINDEX, a list separated by filepath.ListSeparator like
+// $PATH, or else $HOME/.csearchindex.
+func Files() []string {
+	var files []string
+	for _, f := range filepath.SplitList(os.Getenv("CSEARCHINDEX")) {
+		if f != "" {
+			files = append(files, f)
+		}
 	}
-	return filepath.Join(HomeDir(), ".csearchindex")
+	if len(files) == 0 {
+		files = append(files, filepath.Join(HomeDir(), ".csearchindex"))
+	}
+	return files
+}
+
+// File returns the name of the index file to use, for commands
+// working on a single index: the first of Files.
+func File() string {
+	return Files()[0]
 }
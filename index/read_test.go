@@ -9,6 +9,7 @@ package index
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -24,10 +25,18 @@ func tri(x, y, z byte) uint32 {
 }
 
 func TestTrivialPosting(t *testing.T) {
+	testTrivialPosting(t, 1)
+}
+
+func TestTrivialPostingVersion2(t *testing.T) {
+	testTrivialPosting(t, 2)
+}
+
+func testTrivialPosting(t *testing.T, version int) {
 	f, _ := ioutil.TempFile("", "index-test")
 	defer os.Remove(f.Name())
 	out := f.Name()
-	buildIndex(t, out, nil, postFiles)
+	buildIndexVersion(t, out, nil, postFiles, version)
 	ix := Open(out)
 	if l := ix.PostingList(tri('S', 'e', 'a')); !equalList(l, []uint32{1, 3}) {
 		t.Errorf("PostingList(Sea) = %v, want [1 3]", l)
@@ -60,3 +69,77 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestOpenIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good")
+	buildIndex(t, good, nil, postFiles)
+	ix, err := OpenIndex(good)
+	if err != nil {
+		t.Fatalf("OpenIndex(good): %v", err)
+	}
+	if l := ix.PostingList(tri('S', 'e', 'a')); !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingList(Sea) = %v, want [1 3]", l)
+	}
+	ix.Close()
+
+	if _, err := OpenIndex(filepath.Join(dir, "missing")); err == nil || !os.IsNotExist(err) {
+		t.Errorf("OpenIndex(missing) = %v, want not exist error", err)
+	}
+	for _, data := range []string{"", "csearch index 1\n", "csearch index 2\nnot an index\ncsearch infotr\n"} {
+		bad := filepath.Join(dir, "bad")
+		if err := ioutil.WriteFile(bad, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := OpenIndex(bad)
+		if _, ok := err.(*CorruptError); !ok {
+			t.Errorf("OpenIndex(%q) = %v, want *CorruptError", data, err)
+		}
+	}
+}
+
+func TestIndexErr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "index")
+	buildIndex(t, file, nil, postFiles)
+	ix, err := OpenIndex(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := ix.data.d
+	defer func() {
+		ix.data.d = d
+		ix.Close()
+	}()
+	if name := ix.Name(0); name != "file0" || ix.Err() != nil {
+		t.Fatalf("Name(0) = %q, Err() = %v, want file0, nil", name, ix.Err())
+	}
+
+	// Cut the index short, as if it were truncated after it was opened.
+	ix.data.d = d[:ix.nameData+1]
+	if name := ix.Name(0); name != "" {
+		t.Errorf("Name(0) of corrupt index = %q, want empty", name)
+	}
+	if _, ok := ix.Err().(*CorruptError); !ok {
+		t.Fatalf("Err() = %v, want *CorruptError", ix.Err())
+	}
+	if l := ix.PostingList(tri('S', 'e', 'a')); len(l) != 0 {
+		t.Errorf("PostingList(Sea) of corrupt index = %v, want empty", l)
+	}
+	if l := ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{"Sea"}}); len(l) != 0 {
+		t.Errorf("PostingQuery(Sea) of corrupt index = %v, want empty", l)
+	}
+	if fi := ix.FileInfo(3); fi != (FileInfo{}) {
+		t.Errorf("FileInfo(3) of corrupt index = %v, want zero", fi)
+	}
+}
@@ -49,6 +49,11 @@ func (q *Query) or(r *Query) *Query {
 	return q.andOr(r, QOr)
 }
 
+// Or returns the query q OR r, possibly reusing q's and r's storage.
+func (q *Query) Or(r *Query) *Query {
+	return q.or(r)
+}
+
 // andOr returns the query q AND r or q OR r, possibly reusing q's and r's storage.
 // It works hard to avoid creating unnecessarily complicated structures.
 func (q *Query) andOr(r *Query, op QueryOp) (out *Query) {
@@ -339,6 +344,20 @@ func RegexpQuery(re *syntax.Regexp) *Query {
 	return info.match
 }
 
+// LiteralQuery returns a Query for the files that may contain
+// the string s: those containing all its trigrams.
+func LiteralQuery(s string) *Query {
+	if len(s) < 3 {
+		return &Query{Op: QAll}
+	}
+	var t stringSet
+	for i := 0; i+3 <= len(s); i++ {
+		t.add(s[i : i+3])
+	}
+	t.clean(false)
+	return &Query{Op: QAnd, Trigram: t}
+}
+
 // A regexpInfo summarizes the results of analyzing a regexp.
 type regexpInfo struct {
 	// canEmpty records whether the regexp matches the empty string
@@ -94,3 +94,21 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+var literalQueryTests = []struct {
+	s string
+	q string
+}{
+	{`foo.bar(`, `".ba" "ar(" "bar" "foo" "o.b" "oo."`},
+	{`aaaa`, `"aaa"`},
+	{`ab`, `+`},
+}
+
+func TestLiteralQuery(t *testing.T) {
+	for _, tt := range literalQueryTests {
+		q := LiteralQuery(tt.s).String()
+		if q != tt.q {
+			t.Errorf("LiteralQuery(%#q) = %#q, want %#q", tt.s, q, tt.q)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Sharded indexes.
+//
+// A sharded index is a directory holding shards, each an ordinary index
+// file covering some of the indexed paths, and a manifest listing them.
+// cindex updates the shards one at a time, so that a change only
+// rewrites the shard covering it, and no shard grows as large as a
+// single index of everything would.
+//
+// The manifest is a text file named "manifest" with the format:
+//
+//	"csearch shards 1\n"
+//	shard name "\t" path "\n"
+//	...
+//
+// with a line for each path indexed in each shard, giving the shard's
+// file name in the directory.  A shard is listed even if it has no
+// paths yet.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	manifestName  = "manifest"
+	manifestMagic = "csearch shards 1"
+)
+
+// A Manifest lists the shards of a sharded index.
+type Manifest struct {
+	Dir    string // directory of the sharded index
+	Shards []*Shard
+}
+
+// A Shard is one of the index files of a sharded index.
+type Shard struct {
+	Name  string   // file name of the shard in the directory
+	Paths []string // paths indexed in the shard
+}
+
+// IsSharded reports whether path is the directory of a sharded index.
+func IsSharded(path string) bool {
+	_, err := os.Stat(filepath.Join(path, manifestName))
+	return err == nil
+}
+
+// ReadManifest reads the manifest of the sharded index in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Manifest{Dir: dir}
+	s := bufio.NewScanner(f)
+	if !s.Scan() || s.Text() != manifestMagic {
+		return nil, fmt.Errorf("%s: not a shard manifest", f.Name())
+	}
+	for s.Scan() {
+		line := s.Text()
+		i := strings.Index(line, "\t")
+		if i <= 0 || strings.ContainsAny(line[:i], `/\`) {
+			return nil, fmt.Errorf("%s: bad line: %q", f.Name(), line)
+		}
+		sh := m.shard(line[:i])
+		if p := line[i+1:]; p != "" {
+			sh.Paths = append(sh.Paths, p)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// shard returns the shard with the given name, adding it if needed.
+func (m *Manifest) shard(name string) *Shard {
+	for _, sh := range m.Shards {
+		if sh.Name == name {
+			return sh
+		}
+	}
+	sh := &Shard{Name: name}
+	m.Shards = append(m.Shards, sh)
+	return sh
+}
+
+// Write writes the manifest to its directory, replacing the old one.
+func (m *Manifest) Write() error {
+	var b bytes.Buffer
+	b.WriteString(manifestMagic + "\n")
+	for _, sh := range m.Shards {
+		if len(sh.Paths) == 0 {
+			fmt.Fprintf(&b, "%s\t\n", sh.Name)
+		}
+		for _, p := range sh.Paths {
+			fmt.Fprintf(&b, "%s\t%s\n", sh.Name, p)
+		}
+	}
+	file := filepath.Join(m.Dir, manifestName)
+	if err := ioutil.WriteFile(file+"~", b.Bytes(), 0666); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// Windows cannot rename onto an existing file.
+		os.Remove(file)
+	}
+	return os.Rename(file+"~", file)
+}
+
+// File returns the name of the index file of the shard.
+func (m *Manifest) File(sh *Shard) string {
+	return filepath.Join(m.Dir, sh.Name)
+}
+
+// Files returns the names of the index files of the shards.
+func (m *Manifest) Files() []string {
+	var files []string
+	for _, sh := range m.Shards {
+		files = append(files, m.File(sh))
+	}
+	return files
+}
+
+// Lookup returns the shard covering name: the one with a path that is
+// name or a directory containing it.  It returns nil if there is none.
+func (m *Manifest) Lookup(name string) *Shard {
+	for _, sh := range m.Shards {
+		if newPathSet(sh.Paths).covers(name) {
+			return sh
+		}
+	}
+	return nil
+}
+
+// Overlapping returns the shards with a path that is name,
+// a directory containing it or a file or directory under it.
+func (m *Manifest) Overlapping(name string) []*Shard {
+	var list []*Shard
+	within := newPathSet([]string{name})
+	for _, sh := range m.Shards {
+		if newPathSet(sh.Paths).covers(name) {
+			list = append(list, sh)
+			continue
+		}
+		for _, p := range sh.Paths {
+			if within.covers(p) {
+				list = append(list, sh)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// NewShard adds a new shard, with no paths, to the manifest.
+func (m *Manifest) NewShard() *Shard {
+	n := len(m.Shards)
+	for {
+		name := fmt.Sprintf("shard%d", n)
+		if _, err := os.Stat(filepath.Join(m.Dir, name)); os.IsNotExist(err) && !m.has(name) {
+			return m.shard(name)
+		}
+		n++
+	}
+}
+
+// has reports whether the manifest lists a shard with the given name.
+func (m *Manifest) has(name string) bool {
+	for _, sh := range m.Shards {
+		if sh.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes the manifest and the index files of the shards, and
+// the directory if it is then empty.
+func (m *Manifest) Delete() error {
+	for _, file := range m.Files() {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(m.Dir, manifestName)); err != nil {
+		return err
+	}
+	os.Remove(m.Dir)
+	return nil
+}
+
+// Remove removes the shard from the manifest.
+// It does not remove the shard's index file.
+func (m *Manifest) Remove(sh *Shard) {
+	for i, s := range m.Shards {
+		if s == sh {
+			m.Shards = append(m.Shards[:i], m.Shards[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if IsSharded(dir) {
+		t.Fatalf("IsSharded(%s) before writing a manifest", dir)
+	}
+	m := &Manifest{Dir: dir}
+	sh0 := m.NewShard()
+	sh0.Paths = []string{"/a", "/b"}
+	sh1 := m.NewShard()
+	sh1.Paths = []string{"/c/d"}
+	m.NewShard()
+	if err := m.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSharded(dir) {
+		t.Fatalf("IsSharded(%s) = false after writing a manifest", dir)
+	}
+
+	m, err = ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Shard{
+		{Name: "shard0", Paths: []string{"/a", "/b"}},
+		{Name: "shard1", Paths: []string{"/c/d"}},
+		{Name: "shard2"},
+	}
+	if !reflect.DeepEqual(m.Shards, want) {
+		t.Fatalf("ReadManifest: shards %+v, want %+v", m.Shards, want)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		lookup string
+		over   []string
+	}{
+		{"/a/x", "shard0", []string{"shard0"}},
+		{"/b", "shard0", []string{"shard0"}},
+		{"/c", "", []string{"shard1"}},
+		{"/c/d/e", "shard1", []string{"shard1"}},
+		{"/", "", []string{"shard0", "shard1"}},
+		{"/ab", "", nil},
+	} {
+		sh := m.Lookup(tt.name)
+		if sh == nil && tt.lookup != "" || sh != nil && sh.Name != tt.lookup {
+			t.Errorf("Lookup(%s) = %v, want %s", tt.name, sh, tt.lookup)
+		}
+		var over []string
+		for _, sh := range m.Overlapping(tt.name) {
+			over = append(over, sh.Name)
+		}
+		if !reflect.DeepEqual(over, tt.over) {
+			t.Errorf("Overlapping(%s) = %v, want %v", tt.name, over, tt.over)
+		}
+	}
+
+	// A new shard gets a name not used by the manifest or the directory.
+	ioutil.WriteFile(filepath.Join(dir, "shard3"), nil, 0666)
+	if sh := m.NewShard(); sh.Name != "shard4" {
+		t.Errorf("NewShard() = %s, want shard4", sh.Name)
+	}
+	m.Remove(m.Shards[1])
+	if len(m.Shards) != 3 || m.Shards[1].Name != "shard2" {
+		t.Errorf("after Remove(shard1), shards are %+v", m.Shards)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, manifestName), []byte("csearch index 1\n"), 0666)
+	if _, err := ReadManifest(dir); err == nil {
+		t.Errorf("ReadManifest of a bad manifest succeeded")
+	}
+}
+
+func TestOpenMultiShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Manifest{Dir: dir}
+	for _, paths := range []string{"/a", "/b"} {
+		sh := m.NewShard()
+		sh.Paths = []string{paths}
+		buildIndex(t, m.File(sh), sh.Paths, map[string]string{
+			paths + "/1": "Google Code Search",
+			paths + "/2": "Google Web Search",
+		})
+	}
+	if err := m.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := OpenMulti([]string{dir})
+	defer ix.Close()
+	if len(ix.Indexes) != 2 {
+		t.Fatalf("OpenMulti opened %d indexes, want 2", len(ix.Indexes))
+	}
+	q := &Query{Op: QAnd, Trigram: []string{"Cod"}}
+	want := []string{"/a/1", "/b/1"}
+	if names := ix.Names(q); !reflect.DeepEqual(names, want) {
+		t.Errorf("Names(%v) = %v, want %v", q, names, want)
+	}
+}
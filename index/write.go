@@ -7,6 +7,7 @@
 package index
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -34,6 +35,11 @@ import (
 // But we have not implemented that.
 
 // An IndexWriter creates an on-disk index corresponding to a set of files.
+//
+// A writer from Create exits the program with an error message if the
+// index cannot be written.  One from CreateIndex records the first such
+// error instead, ignores the files added after it, and returns it from
+// Flush and Close.
 type IndexWriter struct {
 	LogSkip bool // log information about skipped files
 	Verbose bool // log status using package log
@@ -53,6 +59,8 @@ type IndexWriter struct {
 	postFile  []*os.File  // flushed post entries
 	postIndex *bufWriter  // temp file holding posting list index
 
+	fileInfo *bufWriter // temp file holding file info
+
 	inbuf []byte     // input buffer
 	main  *bufWriter // main index file
 
@@ -61,31 +69,194 @@ type IndexWriter struct {
 	MaxTextTrigrams int
 
 	MaxInvalidUTF8Ratio float64
+
+	// Version is the index format version to write: 1 or 2.
+	// Version 1 indexes are limited to 4 GB, and have no file info
+	// for cindex to find unchanged files by.
+	// It must be set before any files are added.
+	Version int
+
+	// Workers is the number of files AddFile reads at once.
+	// If it is greater than 1, AddFile hands each file to one of
+	// Workers goroutines, which read it and compute its trigrams,
+	// and returns before the file has been read.  The files are
+	// still added to the index in the order of the AddFile calls,
+	// so the index is the same as with sequential reading.
+	// The workers run until Close, each with its own trigram set,
+	// which takes 64 MB, and up to 64 MB more while reading a file
+	// with many trigrams, so memory use grows with Workers.
+	Workers int
+
+	// OnSkip, if not nil, is called for each file that is not added
+	// to the index, in the order the files were added, and on the
+	// goroutine calling AddFile, Add or Flush.
+	OnSkip func(*Skip)
+
+	scanq   chan *fileScan // files for the workers to read
+	pending []*fileScan    // files handed to the workers, in order
+
+	err         error // first error writing the index
+	exitOnError bool  // created by Create: exit on errors writing the index
+}
+
+// A writeError is a failure to write an index.  The code writing
+// indexes panics with it, and the exported functions recover it.
+type writeError struct {
+	err error
+}
+
+// fail panics with a writeError for err.
+func fail(err error) {
+	panic(&writeError{err})
+}
+
+// failf panics with a writeError with the formatted message.
+func failf(format string, args ...interface{}) {
+	fail(fmt.Errorf(format, args...))
+}
+
+// writeErr returns the error of e, a value recovered from a panic,
+// which is panicked with again unless it is a writeError.
+func writeErr(e interface{}) error {
+	we, ok := e.(*writeError)
+	if !ok {
+		panic(e)
+	}
+	return we.err
+}
+
+// exitOnWriteError exits the program with an error message if the
+// function deferring it panics with a writeError.
+func exitOnWriteError() {
+	if e := recover(); e != nil {
+		log.Fatal(writeErr(e))
+	}
+}
+
+// check, deferred by the exported methods, handles their failure
+// to write the index, as described for IndexWriter.
+func (ix *IndexWriter) check() {
+	if e := recover(); e != nil {
+		err := writeErr(e)
+		if ix.exitOnError {
+			log.Fatal(err)
+		}
+		ix.err = err
+	}
+}
+
+// Reasons for not indexing a file, reported in Skip.Reason.
+const (
+	SkipTooLong     = "too-long"          // Value is the file size
+	SkipBinary      = "binary"            // Value is the offset of the NUL byte
+	SkipLongLine    = "long-line"         // Value is the line length read so far
+	SkipTrigrams    = "too-many-trigrams" // Value is the number of trigrams
+	SkipInvalidUTF8 = "invalid-utf8"      // Value is the ratio of invalid UTF-8
+	SkipError       = "error"             // Err is the error
+)
+
+// A Skip describes a file that an IndexWriter did not index.
+type Skip struct {
+	Name   string
+	Reason string  // one of the Skip constants
+	Value  float64 // measured value that exceeded Limit
+	Limit  float64 // the IndexWriter's limit, if Reason has one
+	Err    error   // error reading the file, for SkipError
+}
+
+// A fileScan is a file being read by a worker on behalf of AddFile.
+type fileScan struct {
+	name     string
+	info     FileInfo
+	n        int64     // bytes read
+	trigrams []uint32  // trigrams in the file
+	skip     *Skip     // why the file is not indexed, if it is not
+	done     chan bool // closed once the file has been read
 }
 
 const npost = 64 << 20 / 8 // 64 MB worth of post entries
 
-// Create returns a new IndexWriter that will write the index to file.
+// Create returns a new IndexWriter that will write the index to file,
+// exiting the program with an error message if it cannot.
 func Create(file string) *IndexWriter {
-	return &IndexWriter{
+	ix, err := CreateIndex(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ix.exitOnError = true
+	return ix
+}
+
+// CreateIndex returns a new IndexWriter that will write the index to
+// file, returning an error if the file cannot be created.  The writer
+// returns the errors writing the index from Flush and Close.
+func CreateIndex(file string) (ix *IndexWriter, err error) {
+	ix = &IndexWriter{
 		trigram:             sparse.NewSet(1 << 24),
-		nameData:            bufCreate(""),
-		nameIndex:           bufCreate(""),
-		postIndex:           bufCreate(""),
-		main:                bufCreate(file),
 		post:                make([]postEntry, 0, npost),
 		inbuf:               make([]byte, 16384),
 		MaxFileLen:          1 << 30,
 		MaxLineLen:          2000,
 		MaxTextTrigrams:     20000,
 		MaxInvalidUTF8Ratio: 0.0,
+		Version:             1,
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = writeErr(e)
+			ix.discard()
+			ix = nil
+		}
+	}()
+	ix.main = bufCreate(file)
+	ix.nameData = bufCreate("")
+	ix.nameIndex = bufCreate("")
+	ix.postIndex = bufCreate("")
+	ix.fileInfo = bufCreate("")
+	return ix, nil
+}
+
+// Close stops the workers and closes the index file.  It returns
+// the first error writing the index, if any; the temporary files
+// are then removed, but not the partly written index file.
+func (ix *IndexWriter) Close() error {
+	if ix.err == nil {
+		ix.close()
+	}
+	if ix.scanq != nil {
+		close(ix.scanq)
+		ix.scanq = nil
 	}
+	if ix.err != nil {
+		ix.discard()
+	}
+	return ix.err
 }
 
-func (ix *IndexWriter) Close() {
+func (ix *IndexWriter) close() {
+	defer ix.check()
+	ix.wait()
 	ix.main.finish().Close()
 }
 
+// discard closes the files of a writer that failed to write
+// the index, and removes the temporary ones.
+func (ix *IndexWriter) discard() {
+	for _, b := range []*bufWriter{ix.nameData, ix.nameIndex, ix.postIndex, ix.fileInfo} {
+		if b != nil {
+			b.file.Close()
+			os.Remove(b.name)
+		}
+	}
+	for _, f := range ix.postFile {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if ix.main != nil {
+		ix.main.file.Close()
+	}
+}
+
 // A postEntry is an in-memory (trigram, file#) pair.
 type postEntry uint64
 
@@ -109,34 +280,151 @@ func (ix *IndexWriter) AddPaths(paths []string) {
 // AddFile adds the file with the given name (opened using os.Open)
 // to the index.  It logs errors using package log.
 func (ix *IndexWriter) AddFile(name string) {
+	if ix.err != nil {
+		return
+	}
+	defer ix.check()
+	if ix.Workers > 1 {
+		ix.addFileAsync(name)
+		return
+	}
+	ix.wait()
 	fi, err := os.Stat(name)
 	if err != nil {
 		log.Print(err)
+		ix.skip(&Skip{Name: name, Reason: SkipError, Err: err})
 		return
 	}
 	f, err := os.Open(name)
 	if err != nil {
 		log.Print(err)
+		ix.skip(&Skip{Name: name, Reason: SkipError, Err: err})
 		return
 	}
 	defer f.Close()
-	ix.Add(name, f, fi.Size())
+	ix.add(name, f, fi.Size(), NewFileInfo(fi))
 }
 
 // Add adds the file f to the index under the given name.
 // It logs errors using package log.
+// Nothing is recorded about the file beyond its name and content,
+// so cindex will always reread it.
 func (ix *IndexWriter) Add(name string, f io.Reader, size int64) {
+	if ix.err != nil {
+		return
+	}
+	defer ix.check()
+	ix.wait()
+	ix.add(name, f, size, FileInfo{})
+}
+
+func (ix *IndexWriter) add(name string, f io.Reader, size int64, info FileInfo) {
+	n, skip := ix.scan(ix.trigram, ix.inbuf, name, f, size)
+	if skip != nil {
+		ix.skip(skip)
+		return
+	}
+	ix.commit(name, info, n, ix.trigram.Dense())
+}
+
+// skip reports the skipped file to ix.OnSkip.
+func (ix *IndexWriter) skip(s *Skip) {
+	if ix.OnSkip != nil {
+		ix.OnSkip(s)
+	}
+}
+
+// addFileAsync hands the file with the given name to the workers,
+// starting them if needed, and adds to the index the files that
+// they have finished reading.
+func (ix *IndexWriter) addFileAsync(name string) {
+	if ix.scanq == nil {
+		ix.scanq = make(chan *fileScan, ix.Workers)
+		for i := 0; i < ix.Workers; i++ {
+			go ix.scanFiles(ix.scanq)
+		}
+	}
+	s := &fileScan{name: name, done: make(chan bool)}
+	ix.scanq <- s
+	ix.pending = append(ix.pending, s)
+	// Keep the workers busy, but bound the number of
+	// trigram sets waiting in memory to be added.
+	for len(ix.pending) > 2*ix.Workers {
+		ix.commitPending()
+	}
+}
+
+// scanFiles reads the files sent on q and records their trigrams.
+// It runs in a worker goroutine, with its own trigram set and buffer,
+// which it keeps until q is closed by Close.
+func (ix *IndexWriter) scanFiles(q chan *fileScan) {
+	trigram := sparse.NewSet(1 << 24)
+	inbuf := make([]byte, len(ix.inbuf))
+	for s := range q {
+		ix.scanFile(s, trigram, inbuf)
+		close(s.done)
+	}
+}
+
+func (ix *IndexWriter) scanFile(s *fileScan, trigram *sparse.Set, inbuf []byte) {
+	fi, err := os.Stat(s.name)
+	if err != nil {
+		log.Print(err)
+		s.skip = &Skip{Name: s.name, Reason: SkipError, Err: err}
+		return
+	}
+	f, err := os.Open(s.name)
+	if err != nil {
+		log.Print(err)
+		s.skip = &Skip{Name: s.name, Reason: SkipError, Err: err}
+		return
+	}
+	defer f.Close()
+	s.info = NewFileInfo(fi)
+	s.n, s.skip = ix.scan(trigram, inbuf, s.name, f, fi.Size())
+	if s.skip == nil {
+		s.trigrams = append([]uint32{}, trigram.Dense()...)
+	}
+}
+
+// commitPending waits for the oldest file handed to the workers
+// and adds it to the index, or reports it as skipped.
+func (ix *IndexWriter) commitPending() {
+	s := ix.pending[0]
+	ix.pending[0] = nil
+	ix.pending = ix.pending[1:]
+	<-s.done
+	if s.skip != nil {
+		ix.skip(s.skip)
+		return
+	}
+	ix.commit(s.name, s.info, s.n, s.trigrams)
+}
+
+// wait adds to the index all the files handed to the workers.
+// The workers keep running, ready for more files.
+func (ix *IndexWriter) wait() {
+	for len(ix.pending) > 0 {
+		ix.commitPending()
+	}
+}
+
+// scan reads f, which has the given name and size, collecting its
+// trigrams in the set trigram and using inbuf as its read buffer.
+// It returns the number of bytes read, or, if the file should not be
+// indexed, why not; with ix.LogSkip, it also logs the reason.
+func (ix *IndexWriter) scan(trigram *sparse.Set, inbuf []byte, name string, f io.Reader, size int64) (int64, *Skip) {
 	if size > ix.MaxFileLen {
 		if ix.LogSkip {
 			log.Printf("%s: too long, ignoring\n", name)
 		}
-		return
+		return 0, &Skip{Name: name, Reason: SkipTooLong, Value: float64(size), Limit: float64(ix.MaxFileLen)}
 	}
-	ix.trigram.Reset()
+	trigram.Reset()
 	var (
 		c           = byte(0)
 		i           = 0
-		buf         = ix.inbuf[:0]
+		buf         = inbuf[:0]
 		tv          = uint32(0)
 		n           = int64(0)
 		linelen     = 0
@@ -155,10 +443,10 @@ func (ix *IndexWriter) Add(name string, f io.Reader, size int64) {
 						break
 					}
 					log.Printf("%s: %v\n", name, err)
-					return
+					return 0, &Skip{Name: name, Reason: SkipError, Err: err}
 				}
 				log.Printf("%s: 0-length read\n", name)
-				return
+				return 0, &Skip{Name: name, Reason: SkipError, Err: io.ErrNoProgress}
 			}
 			buf = buf[:n]
 			i = 0
@@ -174,23 +462,23 @@ func (ix *IndexWriter) Add(name string, f io.Reader, size int64) {
 					if ix.LogSkip {
 						log.Printf("%s: skipped. High invalid UTF-8 ratio. total: %d invalid: %d ratio: %f\n", name, size, inv_cnt, float64(inv_cnt)/float64(size))
 					}
-					return
+					return 0, &Skip{Name: name, Reason: SkipInvalidUTF8, Value: float64(inv_cnt) / float64(size), Limit: ix.MaxInvalidUTF8Ratio}
 				}
 			} else {
-				ix.trigram.Add(tv)
+				trigram.Add(tv)
 			}
 		}
 		if (b1 == 0x00 || b2 == 0x00) && n >= 3 {
 			if ix.LogSkip {
 				log.Printf("%s: skipped. Binary file. Bytes %02X%02X at offset %d\n", name, (tv>>8)&0xFF, tv&0xFF, n)
 			}
-			return
+			return 0, &Skip{Name: name, Reason: SkipBinary, Value: float64(n)}
 		}
 		if linelen++; linelen > ix.MaxLineLen {
 			if ix.LogSkip {
 				log.Printf("%s: skipped. Very long lines (%d)\n", name, linelen)
 			}
-			return
+			return 0, &Skip{Name: name, Reason: SkipLongLine, Value: float64(linelen), Limit: float64(ix.MaxLineLen)}
 		}
 		if c == '\n' {
 			linelen = 0
@@ -201,23 +489,30 @@ func (ix *IndexWriter) Add(name string, f io.Reader, size int64) {
 			if ix.LogSkip {
 				log.Printf("%s: skipped. High invalid UTF-8 ratio. total: %d invalid: %d ratio: %f\n", name, size, inv_cnt, float64(inv_cnt)/float64(size))
 			}
-			return
+			return 0, &Skip{Name: name, Reason: SkipInvalidUTF8, Value: float64(inv_cnt) / float64(size), Limit: ix.MaxInvalidUTF8Ratio}
 		}
 	}
-	if ix.trigram.Len() > ix.MaxTextTrigrams {
+	if trigram.Len() > ix.MaxTextTrigrams {
 		if ix.LogSkip {
-			log.Printf("%s: skipped. Too many trigrams (%d > %d)\n", name, ix.trigram.Len(), ix.MaxTextTrigrams)
+			log.Printf("%s: skipped. Too many trigrams (%d > %d)\n", name, trigram.Len(), ix.MaxTextTrigrams)
 		}
-		return
+		return 0, &Skip{Name: name, Reason: SkipTrigrams, Value: float64(trigram.Len()), Limit: float64(ix.MaxTextTrigrams)}
 	}
+	return n, nil
+}
+
+// commit adds the file with the given name, info, length in bytes
+// and trigrams to the index.
+func (ix *IndexWriter) commit(name string, info FileInfo, n int64, trigrams []uint32) {
 	ix.totalBytes += n
 
 	if ix.Verbose {
-		log.Printf("%d %d %s\n", n, ix.trigram.Len(), name)
+		log.Printf("%d %d %s\n", n, len(trigrams), name)
 	}
 
 	fileid := ix.addName(name)
-	for _, trigram := range ix.trigram.Dense() {
+	ix.fileInfo.writeFileInfo(info)
+	for _, trigram := range trigrams {
 		if len(ix.post) >= cap(ix.post) {
 			ix.flushPost()
 		}
@@ -226,11 +521,25 @@ func (ix *IndexWriter) Add(name string, f io.Reader, size int64) {
 }
 
 // Flush flushes the index entry to the target file.
-func (ix *IndexWriter) Flush() {
+// It returns the first error writing the index, if any.
+func (ix *IndexWriter) Flush() error {
+	if ix.err == nil {
+		ix.flush()
+	}
+	return ix.err
+}
+
+func (ix *IndexWriter) flush() {
+	defer ix.check()
+	ix.wait()
 	ix.addName("")
 
-	var off [5]uint32
-	ix.main.writeString(magic)
+	var off [6]uint64
+	if ix.Version >= 2 {
+		ix.main.writeString(magic2)
+	} else {
+		ix.main.writeString(magic)
+	}
 	off[0] = ix.main.offset()
 	for _, p := range ix.paths {
 		ix.main.writeString(p)
@@ -245,10 +554,19 @@ func (ix *IndexWriter) Flush() {
 	copyFile(ix.main, ix.nameIndex)
 	off[4] = ix.main.offset()
 	copyFile(ix.main, ix.postIndex)
-	for _, v := range off {
-		ix.main.writeUint32(v)
+	if ix.Version >= 2 {
+		off[5] = ix.main.offset()
+		copyFile(ix.main, ix.fileInfo)
+		for _, v := range off {
+			ix.main.writeOffset(v, ix.Version)
+		}
+		ix.main.writeString(infoTrailerMagic)
+	} else {
+		for _, v := range off[:5] {
+			ix.main.writeOffset(v, ix.Version)
+		}
+		ix.main.writeString(trailerMagic)
 	}
-	ix.main.writeString(trailerMagic)
 
 	os.Remove(ix.nameData.name)
 	for _, f := range ix.postFile {
@@ -256,6 +574,7 @@ func (ix *IndexWriter) Flush() {
 	}
 	os.Remove(ix.nameIndex.name)
 	os.Remove(ix.postIndex.name)
+	os.Remove(ix.fileInfo.name)
 
 	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
 
@@ -266,7 +585,7 @@ func copyFile(dst, src *bufWriter) {
 	dst.flush()
 	_, err := io.Copy(dst.file, src.finish())
 	if err != nil {
-		log.Fatalf("copying %s to %s: %v", src.name, dst.name, err)
+		failf("copying %s to %s: %v", src.name, dst.name, err)
 	}
 }
 
@@ -274,10 +593,10 @@ func copyFile(dst, src *bufWriter) {
 // It returns the assigned file ID number.
 func (ix *IndexWriter) addName(name string) uint32 {
 	if strings.Contains(name, "\x00") {
-		log.Fatalf("%q: file has NUL byte in name", name)
+		failf("%q: file has NUL byte in name", name)
 	}
 
-	ix.nameIndex.writeUint32(ix.nameData.offset())
+	ix.nameIndex.writeOffset(ix.nameData.offset(), ix.Version)
 	ix.nameData.writeString(name)
 	ix.nameData.writeByte(0)
 	id := ix.numName
@@ -290,7 +609,7 @@ func (ix *IndexWriter) addName(name string) uint32 {
 func (ix *IndexWriter) flushPost() {
 	w, err := ioutil.TempFile("", "csearch-index")
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
 	if ix.Verbose {
 		log.Printf("flush %d entries to %s", len(ix.post), w.Name())
@@ -302,9 +621,9 @@ func (ix *IndexWriter) flushPost() {
 	data := (*[npost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
 	if n, err := w.Write(data); err != nil || n < len(data) {
 		if err != nil {
-			log.Fatal(err)
+			fail(err)
 		}
-		log.Fatalf("short write writing %s", w.Name())
+		failf("short write writing %s", w.Name())
 	}
 
 	ix.post = ix.post[:0]
@@ -349,7 +668,7 @@ func (ix *IndexWriter) mergePost(out *bufWriter) {
 		// index entry
 		ix.postIndex.write(ix.buf[:3])
 		ix.postIndex.writeUint32(nfile)
-		ix.postIndex.writeUint32(offset)
+		ix.postIndex.writeOffset(offset, ix.Version)
 
 		if trigram == 1<<24-1 {
 			break
@@ -372,7 +691,11 @@ type postHeap struct {
 }
 
 func (h *postHeap) addFile(f *os.File) {
-	data := mmapFile(f).d
+	mm, err := mmapFile(f)
+	if err != nil {
+		fail(err)
+	}
+	data := mm.d
 	m := (*[npost]postEntry)(unsafe.Pointer(&data[0]))[:len(data)/8]
 	h.addMem(m)
 }
@@ -504,7 +827,7 @@ func bufCreate(name string) *bufWriter {
 		f, err = ioutil.TempFile("", "csearch")
 	}
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
 	return &bufWriter{
 		name: f.Name(),
@@ -519,7 +842,7 @@ func (b *bufWriter) write(x []byte) {
 		b.flush()
 		if len(x) >= cap(b.buf) {
 			if _, err := b.file.Write(x); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
+				failf("writing %s: %v", b.name, err)
 			}
 			return
 		}
@@ -540,7 +863,7 @@ func (b *bufWriter) writeString(s string) {
 		b.flush()
 		if len(s) >= cap(b.buf) {
 			if _, err := b.file.WriteString(s); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
+				failf("writing %s: %v", b.name, err)
 			}
 			return
 		}
@@ -549,13 +872,10 @@ func (b *bufWriter) writeString(s string) {
 }
 
 // offset returns the current write offset.
-func (b *bufWriter) offset() uint32 {
+func (b *bufWriter) offset() uint64 {
 	off, _ := b.file.Seek(0, 1)
 	off += int64(len(b.buf))
-	if int64(uint32(off)) != off {
-		log.Fatalf("index is larger than 4GB")
-	}
-	return uint32(off)
+	return uint64(off)
 }
 
 func (b *bufWriter) flush() {
@@ -564,7 +884,7 @@ func (b *bufWriter) flush() {
 	}
 	_, err := b.file.Write(b.buf)
 	if err != nil {
-		log.Fatalf("writing %s: %v", b.name, err)
+		failf("writing %s: %v", b.name, err)
 	}
 	b.buf = b.buf[:0]
 }
@@ -591,6 +911,29 @@ func (b *bufWriter) writeUint32(x uint32) {
 	b.buf = append(b.buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
 }
 
+func (b *bufWriter) writeUint64(x uint64) {
+	b.writeUint32(uint32(x >> 32))
+	b.writeUint32(uint32(x))
+}
+
+// writeOffset writes an offset in the given index format version.
+func (b *bufWriter) writeOffset(x uint64, version int) {
+	if version >= 2 {
+		b.writeUint64(x)
+		return
+	}
+	if uint64(uint32(x)) != x {
+		failf("index is larger than 4GB; use index format version 2")
+	}
+	b.writeUint32(uint32(x))
+}
+
+func (b *bufWriter) writeFileInfo(fi FileInfo) {
+	b.writeUint64(uint64(fi.ModTime))
+	b.writeUint64(uint64(fi.Size))
+	b.writeUint64(fi.Inode)
+}
+
 func (b *bufWriter) writeUvarint(x uint32) {
 	if cap(b.buf)-len(b.buf) < 5 {
 		b.flush()
@@ -8,8 +8,10 @@ package index
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -117,8 +119,9 @@ func fileList(list ...uint32) string {
 	return string(buf)
 }
 
-func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fileData map[string]string) {
+func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fileData map[string]string, version int) {
 	ix := Create(out)
+	ix.Version = version
 	ix.AddPaths(paths)
 	var files []string
 	for name := range fileData {
@@ -136,14 +139,18 @@ func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fil
 }
 
 func buildIndex(t *testing.T, name string, paths []string, fileData map[string]string) {
-	buildFlushIndex(t, name, paths, false, fileData)
+	buildFlushIndex(t, name, paths, false, fileData, 1)
+}
+
+func buildIndexVersion(t *testing.T, name string, paths []string, fileData map[string]string, version int) {
+	buildFlushIndex(t, name, paths, false, fileData, version)
 }
 
 func testTrivialWrite(t *testing.T, doFlush bool) {
 	f, _ := ioutil.TempFile("", "index-test")
 	defer os.Remove(f.Name())
 	out := f.Name()
-	buildFlushIndex(t, out, nil, doFlush, trivialFiles)
+	buildFlushIndex(t, out, nil, doFlush, trivialFiles, 1)
 
 	data, err := ioutil.ReadFile(out)
 	if err != nil {
@@ -166,3 +173,195 @@ func TestTrivialWrite(t *testing.T) {
 func TestTrivialWriteDisk(t *testing.T) {
 	testTrivialWrite(t, true)
 }
+
+func TestWriteVersion2(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildFlushIndex(t, out, []string{"/"}, true, trivialFiles, 2)
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("csearch index 2\n")) {
+		t.Fatalf("wrong header: %q", data[:16])
+	}
+	// Same as version 1 but with 4 more bytes for each of the
+	// 7 name index entries, 12 posting list index entries and
+	// 5 trailer offsets, a longer path list, and the file info
+	// of the 6 files, unknown for files added with Add, with
+	// its offset in the trailer.
+	if want := len(trivialIndex) + 4*(7+12+5) + 2 + 6*24 + 8; len(data) != want {
+		t.Errorf("index is %d bytes, want %d", len(data), want)
+	}
+
+	ix := Open(out)
+	defer ix.Close()
+	if v := ix.Version(); v != 2 {
+		t.Errorf("Version() = %d, want 2", v)
+	}
+	if p := ix.Paths(); len(p) != 1 || p[0] != "/" {
+		t.Errorf("Paths() = %q, want [/]", p)
+	}
+	names := []string{"afile4", "f0", "file1", "file3", "file5", "thefile2"}
+	for i, name := range names {
+		if n := ix.Name(uint32(i)); n != name {
+			t.Errorf("Name(%d) = %s, want %s", i, n, name)
+		}
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	for _, name := range []string{"a", "b"} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte("hello "+name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	out := filepath.Join(dir, "index")
+	w := Create(out)
+	w.Version = 2
+	w.AddPaths([]string{dir})
+	for _, name := range names {
+		w.AddFile(name)
+	}
+	w.Flush()
+	w.Close()
+
+	ix := Open(out)
+	defer ix.Close()
+	for _, name := range names {
+		id, ok := ix.Lookup(name)
+		if !ok {
+			t.Errorf("Lookup(%s) failed", name)
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := ix.FileInfo(id), NewFileInfo(fi); have != want {
+			t.Errorf("FileInfo(%s) = %+v, want %+v", name, have, want)
+		}
+	}
+	if _, ok := ix.Lookup(filepath.Join(dir, "c")); ok {
+		t.Errorf("Lookup of unindexed file succeeded")
+	}
+}
+
+func TestAddFileWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%03d", i))
+		data := strings.Repeat(fmt.Sprintf("line %d of %s\n", i*i, name), i%7)
+		if i%10 == 3 {
+			data += "\x00binary"
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, filepath.Join(dir, "missing"))
+
+	build := func(out string, workers int) []byte {
+		w := Create(out)
+		w.Workers = workers
+		w.AddPaths([]string{dir})
+		for _, name := range names {
+			w.AddFile(name)
+		}
+		w.Flush()
+		w.Close()
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	want := build(filepath.Join(dir, "index1"), 1)
+	for _, workers := range []int{2, 4, 32} {
+		if have := build(filepath.Join(dir, "index2"), workers); !bytes.Equal(have, want) {
+			t.Errorf("index built with %d workers differs from sequential index", workers)
+		}
+	}
+}
+
+func TestOnSkip(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	ix := Create(f.Name())
+	ix.MaxLineLen = 10
+	ix.MaxTextTrigrams = 5
+	var have []Skip
+	ix.OnSkip = func(s *Skip) { have = append(have, *s) }
+	for _, file := range []struct{ name, data string }{
+		{"ok", "abc\n"},
+		{"binary", "ab\x00cd"},
+		{"longline", "0123456789abcdef\n"},
+		{"trigrams", "abcdefgh\n"},
+	} {
+		r := strings.NewReader(file.data)
+		ix.Add(file.name, r, int64(r.Len()))
+	}
+	ix.Flush()
+	ix.Close()
+
+	want := []Skip{
+		{Name: "binary", Reason: SkipBinary, Value: 3},
+		{Name: "longline", Reason: SkipLongLine, Value: 11, Limit: 10},
+		{Name: "trigrams", Reason: SkipTrigrams, Value: 7, Limit: 5},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("skipped %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("skip %d = %+v, want %+v", i, have[i], want[i])
+		}
+	}
+}
+
+func TestCreateIndexError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if ix, err := CreateIndex(filepath.Join(dir, "missing", "index")); err == nil || ix != nil {
+		t.Errorf("CreateIndex in a missing directory = %v, %v, want nil, error", ix, err)
+	}
+
+	ix, err := CreateIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ok", "bad\x00name", "after"} {
+		r := strings.NewReader("abcdef\n")
+		ix.Add(name, r, int64(r.Len()))
+	}
+	if err := ix.Flush(); err == nil || !strings.Contains(err.Error(), "NUL byte") {
+		t.Errorf("Flush() = %v, want NUL byte error", err)
+	}
+	if err := ix.Close(); err == nil || !strings.Contains(err.Error(), "NUL byte") {
+		t.Errorf("Close() = %v, want NUL byte error", err)
+	}
+}
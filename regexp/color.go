@@ -0,0 +1,214 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Colored output.  With Grep.Color set to "always", or to "auto" and
+// Stdout a terminal, file names, line numbers, separators and the
+// matches within each line are highlighted using ANSI escape sequences.
+// The colors are taken from $GREP_COLORS, in the format used by GNU grep:
+// a colon-separated list of capabilities such as
+//
+//	ms=01;31:fn=35:ln=32:se=36
+//
+// where ms (or mt) is the color of matches, sl and cx those of the rest
+// of matching and context lines, fn, ln and se those of file names,
+// line numbers and separators, and the boolean ne disables the
+// erase-to-end-of-line sequence that follows each color change.
+// Other capabilities are ignored.
+
+// Color modes for Grep.Color.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// A colorMode is a flag.Value accepting only the color modes.
+type colorMode string
+
+func (c *colorMode) String() string { return string(*c) }
+
+func (c *colorMode) Set(s string) error {
+	switch s {
+	case ColorAuto, ColorAlways, ColorNever:
+		*c = colorMode(s)
+		return nil
+	}
+	return fmt.Errorf("want %s, %s or %s", ColorAuto, ColorAlways, ColorNever)
+}
+
+// colors holds the SGR parameters used for each part of the output.
+type colors struct {
+	match    string // ms: matched text
+	selected string // sl: rest of matching lines
+	context  string // cx: rest of context lines
+	file     string // fn: file names
+	line     string // ln: line numbers
+	sep      string // se: separators
+	noErase  bool   // ne: do not erase to end of line
+}
+
+// defaultColors are GNU grep's defaults.
+var defaultColors = colors{
+	match: "01;31",
+	file:  "35",
+	line:  "32",
+	sep:   "36",
+}
+
+// parseColors returns the colors described by s, in the format
+// of $GREP_COLORS, starting from the defaults.
+func parseColors(s string) *colors {
+	c := defaultColors
+	for _, f := range strings.Split(s, ":") {
+		name, val := f, ""
+		if i := strings.Index(f, "="); i >= 0 {
+			name, val = f[:i], f[i+1:]
+		}
+		switch name {
+		case "mt", "ms":
+			c.match = val
+		case "sl":
+			c.selected = val
+		case "cx":
+			c.context = val
+		case "fn":
+			c.file = val
+		case "ln":
+			c.line = val
+		case "se":
+			c.sep = val
+		case "ne":
+			c.noErase = true
+		}
+	}
+	return &c
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// palette returns the colors to print with, or nil if
+// output is not colored.
+func (g *Grep) palette() *colors {
+	if !g.colorSet {
+		g.colorSet = true
+		g.colors = nil
+		if !g.JSON && (g.Color == ColorAlways || g.Color == ColorAuto && isTerminal(g.Stdout)) {
+			g.colors = parseColors(os.Getenv("GREP_COLORS"))
+		}
+	}
+	return g.colors
+}
+
+// paint writes s to w in the color given by the SGR parameters sgr.
+func (c *colors) paint(w io.Writer, sgr string, s []byte) {
+	if sgr == "" || len(s) == 0 {
+		w.Write(s)
+		return
+	}
+	erase := "\x1b[K"
+	if c.noErase {
+		erase = ""
+	}
+	fmt.Fprintf(w, "\x1b[%sm%s%s\x1b[m%s", sgr, erase, s, erase)
+}
+
+// noColors paints nothing, for printing the parts of
+// a line one by one without color.
+var noColors colors
+
+// printPainted is printLine for colored output and for the -o, -column
+// and -showpattern modes, which need to know more about the matches.
+func (g *Grep) printPainted(c *colors, lineno int, offset int64, sep byte, line []byte) {
+	w := &g.out
+	w.Reset()
+	eol := bytes.HasSuffix(line, nl)
+	text := bytes.TrimSuffix(line, nl)
+	var spans [][2]int
+	pattern := 0
+	if sep == ':' {
+		spans = g.Regexp.LineMatches(text, offset == 0, !eol)
+		if g.ShowPattern {
+			pattern = g.Regexp.MatchPattern(text, offset == 0, !eol) + 1
+		}
+	}
+	if g.O {
+		for _, m := range spans {
+			if m[0] == m[1] {
+				continue
+			}
+			col := 0
+			if g.Column {
+				col = m[0] + 1
+			}
+			g.paintPrefix(c, lineno, col, pattern, sep)
+			c.paint(w, c.match, text[m[0]:m[1]])
+			w.Write(nl)
+		}
+		g.Stdout.Write(w.Bytes())
+		return
+	}
+	col := 0
+	if g.Column && len(spans) > 0 {
+		col = spans[0][0] + 1
+	}
+	g.paintPrefix(c, lineno, col, pattern, sep)
+	if sep != ':' {
+		c.paint(w, c.context, text)
+	} else {
+		pos := 0
+		for _, m := range spans {
+			c.paint(w, c.selected, text[pos:m[0]])
+			c.paint(w, c.match, text[m[0]:m[1]])
+			pos = m[1]
+		}
+		c.paint(w, c.selected, text[pos:])
+	}
+	if eol {
+		w.Write(nl)
+	}
+	g.Stdout.Write(w.Bytes())
+}
+
+// paintPrefix adds the file name, line number, column and pattern
+// number, as requested, to the output line being built.
+// A column or pattern number of 0 is not printed.
+func (g *Grep) paintPrefix(c *colors, lineno, col, pattern int, sep byte) {
+	w := &g.out
+	if !g.H {
+		c.paint(w, c.file, []byte(g.name))
+		c.paint(w, c.sep, []byte{sep})
+	}
+	if g.N {
+		c.paint(w, c.line, strconv.AppendInt(nil, int64(lineno), 10))
+		c.paint(w, c.sep, []byte{sep})
+	}
+	if col > 0 {
+		c.paint(w, c.line, strconv.AppendInt(nil, int64(col), 10))
+		c.paint(w, c.sep, []byte{sep})
+	}
+	if pattern > 0 {
+		c.paint(w, c.line, strconv.AppendInt(nil, int64(pattern), 10))
+		c.paint(w, c.sep, []byte{sep})
+	}
+}
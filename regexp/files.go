@@ -0,0 +1,134 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"bytes"
+	"sync"
+)
+
+// A fileSearch is a file searched by one of the goroutines of Files,
+// with the output to be printed once the files before it have been.
+type fileSearch struct {
+	name    string
+	out     bytes.Buffer
+	errs    bytes.Buffer
+	printed int64 // count towards the -m limit
+	match   bool  // some line was selected
+	grouped bool  // some lines were printed with context
+	done    chan bool
+}
+
+// Files searches the named files, printing the same output as calls
+// to File for each in turn, up to the -m limit.  It searches up to
+// workers files at a time, each with its own copy of the Regexp.
+func (g *Grep) Files(names []string, workers int) {
+	if workers <= 1 {
+		for _, name := range names {
+			g.File(name)
+			// short circuit here too
+			if g.Done {
+				break
+			}
+		}
+		return
+	}
+
+	// Decide on colors before the output goes to buffers.
+	g.palette()
+
+	var (
+		searchq = make(chan *fileSearch, workers)
+		orderq  = make(chan *fileSearch, workers)
+		quit    = make(chan bool)
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(w *Grep) {
+			defer wg.Done()
+			for f := range searchq {
+				select {
+				case <-quit:
+				default:
+					w.search(f)
+				}
+				close(f.done)
+			}
+		}(g.clone())
+	}
+	go func() {
+		defer close(searchq)
+		defer close(orderq)
+		for _, name := range names {
+			f := &fileSearch{name: name, done: make(chan bool)}
+			select {
+			case orderq <- f:
+			case <-quit:
+				return
+			}
+			searchq <- f
+		}
+	}()
+	for f := range orderq {
+		<-f.done
+		g.commit(f)
+		if g.Done {
+			break
+		}
+	}
+	close(quit)
+	wg.Wait()
+}
+
+// clone returns a copy of g for searching files on another goroutine.
+func (g *Grep) clone() *Grep {
+	w := *g
+	w.Regexp = g.Regexp.Copy()
+	w.buf = nil
+	w.before = nil
+	w.out = bytes.Buffer{}
+	return &w
+}
+
+// search searches the file f on its own, as if it were the first.
+func (g *Grep) search(f *fileSearch) {
+	g.Stdout = &f.out
+	g.Stderr = &f.errs
+	g.Done = false
+	g.Match = false
+	g.lines_printed = 0
+	g.grouped = false
+	g.File(f.name)
+	f.printed = g.lines_printed
+	f.match = g.Match
+	f.grouped = g.grouped
+}
+
+// commit prints the output of the search of f.
+func (g *Grep) commit(f *fileSearch) {
+	if g.max_print_lines > 0 && g.lines_printed+f.printed > g.max_print_lines {
+		// The file goes over the limit: search it again,
+		// this time stopping there.
+		g.File(f.name)
+		return
+	}
+	if f.grouped && g.grouped {
+		g.printSeparator()
+	}
+	g.Stdout.Write(f.out.Bytes())
+	g.Stderr.Write(f.errs.Bytes())
+	g.lines_printed += f.printed
+	if f.match {
+		g.Match = true
+	}
+	if f.grouped {
+		g.grouped = true
+	}
+	if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
+		g.Done = true
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// JSON output.  With Grep.JSON set, each printed line becomes a JSON
+// object on a line of its own:
+//
+//	{"type":"match","path":"a.go","line":3,"offset":52,"matches":[{"start":5,"end":9}],"text":"func main() {"}
+//	{"type":"context","path":"a.go","line":4,"offset":66,"text":"}"}
+//
+// The offset is the byte offset of the line in the file, and matches
+// lists the byte offsets in the line where matches start and end.
+// With Grep.ShowPattern set, pattern is the number, counting from 1,
+// of the first of the Regexp's Patterns that matches the line.
+// The text is the line without its terminating newline.  Paths and
+// lines that are not valid UTF-8 are reported base64-encoded, in
+// path_base64 and text_base64 instead of path and text.
+//
+// With -l, each matching file is reported as {"type":"file","path":...},
+// and with -c, each file's count as {"type":"count","path":...,"count":N}.
+
+type jsonLine struct {
+	Type       string     `json:"type"`
+	Path       string     `json:"path,omitempty"`
+	PathBase64 []byte     `json:"path_base64,omitempty"`
+	Line       int        `json:"line"`
+	Offset     int64      `json:"offset"`
+	Matches    []jsonSpan `json:"matches,omitempty"`
+	Pattern    int        `json:"pattern,omitempty"`
+	Text       *string    `json:"text,omitempty"`
+	TextBase64 []byte     `json:"text_base64,omitempty"`
+}
+
+type jsonSpan struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type jsonFile struct {
+	Type       string `json:"type"`
+	Path       string `json:"path,omitempty"`
+	PathBase64 []byte `json:"path_base64,omitempty"`
+}
+
+type jsonCount struct {
+	Type       string `json:"type"`
+	Path       string `json:"path,omitempty"`
+	PathBase64 []byte `json:"path_base64,omitempty"`
+	Count      int    `json:"count"`
+}
+
+// jsonString returns s if it is valid UTF-8, or else "".
+func jsonString(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return ""
+}
+
+// jsonBytes returns nil if s is valid UTF-8, or else s as bytes,
+// which package json encodes in base64.
+func jsonBytes(s string) []byte {
+	if utf8.ValidString(s) {
+		return nil
+	}
+	return []byte(s)
+}
+
+// printJSON prints v as a line of JSON.
+func (g *Grep) printJSON(v interface{}) {
+	enc := json.NewEncoder(g.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(g.Stderr, "%s: %v\n", g.name, err)
+	}
+}
+
+// printJSONLine prints a line with the given number and offset in the
+// file as JSON, as a match if sep is ':' or else as context.
+func (g *Grep) printJSONLine(lineno int, offset int64, sep byte, line []byte) {
+	g.printJSON(g.match(lineno, offset, sep, line).jsonLine())
+}
+
+// jsonLine returns m in the JSON format.
+func (m *Match) jsonLine() *jsonLine {
+	l := &jsonLine{
+		Type:       "match",
+		Path:       jsonString(m.Path),
+		PathBase64: jsonBytes(m.Path),
+		Line:       m.Line,
+		Offset:     m.Offset,
+		Pattern:    m.Pattern,
+	}
+	if m.Context {
+		l.Type = "context"
+	}
+	for _, s := range m.Spans {
+		l.Matches = append(l.Matches, jsonSpan{s[0], s[1]})
+	}
+	if utf8.Valid(m.Text) {
+		text := string(m.Text)
+		l.Text = &text
+	} else {
+		l.TextBase64 = m.Text
+	}
+	return l
+}
+
+// MarshalJSON encodes m as a JSON object, in the format of the
+// lines printed with Grep.JSON.
+func (m *Match) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.jsonLine())
+}
@@ -12,9 +12,14 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	stdregexp "regexp"
 	"regexp/syntax"
 	"sort"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/junkblocker/codesearch/sparse"
 )
@@ -26,6 +31,13 @@ type matcher struct {
 	start     *dstate            // start state
 	startLine *dstate            // start state for beginning of line
 	z1, z2    nstate             // two temporary nstates
+
+	// A matcher normally looks for a match starting anywhere
+	// and stops at the first match, entering dmatch.
+	// These flags change that, for locating matches in a line.
+	anchored  bool              // only look for a match starting at the beginning
+	longest   bool              // keep going after a match, marking dstate.match
+	startFlag map[flags]*dstate // start states by flags, for anchored matchers
 }
 
 // An nstate corresponds to an NFA state.
@@ -39,11 +51,12 @@ type nstate struct {
 type flags uint32
 
 const (
-	flagBOL  flags = 1 << iota // beginning of line
-	flagEOL                    // end of line
-	flagBOT                    // beginning of text
-	flagEOT                    // end of text
-	flagWord                   // last byte was word byte
+	flagBOL   flags = 1 << iota // beginning of line
+	flagEOL                     // end of line
+	flagBOT                     // beginning of text
+	flagEOT                     // end of text
+	flagWord                    // last byte was word byte
+	flagMatch                   // a match ended before the last byte
 )
 
 // A dstate corresponds to a DFA state.
@@ -52,6 +65,8 @@ type dstate struct {
 	enc      string       // encoded nstate
 	matchNL  bool         // match when next byte is \n
 	matchEOT bool         // match in this state at end of text
+	match    bool         // longest matcher: a match ended before the last byte
+	dead     bool         // anchored matcher: no match is possible any more
 }
 
 func (z *nstate) String() string {
@@ -159,7 +174,9 @@ func (m *matcher) stepEmpty(runq, nextq *sparse.Set, flag syntax.EmptyOp) {
 // c is either an input byte or endText.
 func (m *matcher) stepByte(runq, nextq *sparse.Set, c int, flag syntax.EmptyOp) (match bool) {
 	nextq.Reset()
-	m.addq(nextq, uint32(m.prog.Start), flag)
+	if !m.anchored {
+		m.addq(nextq, uint32(m.prog.Start), flag)
+	}
 	for _, id := range runq.Dense() {
 		i := &m.prog.Inst[id]
 		switch i.Op {
@@ -260,7 +277,10 @@ func (m *matcher) computeNext(d *dstate, c int) *dstate {
 
 	// re-add start, process rune + expand according to flags.
 	if m.stepByte(&this.q, &next.q, c, flag) {
-		return &dmatch
+		if !m.longest {
+			return &dmatch
+		}
+		next.flag |= flagMatch
 	}
 	return m.cache(next)
 }
@@ -274,6 +294,11 @@ func (m *matcher) cache(z *nstate) *dstate {
 
 	d = &dstate{enc: enc}
 	m.dstate[enc] = d
+	if m.longest {
+		d.match = z.flag&flagMatch != 0
+		d.dead = m.anchored && z.q.Len() == 0
+		return d
+	}
 	d.matchNL = m.computeNext(d, '\n') == &dmatch
 	d.matchEOT = m.computeNext(d, endText) == &dmatch
 	return d
@@ -356,12 +381,37 @@ type Grep struct {
 	Stdout io.Writer // output target
 	Stderr io.Writer // error target
 
+	E           []string // e flag - patterns to search for
+	PatternFile string   // patterns flag - file of patterns to search for, one per line
+	F           bool     // F flag - patterns are fixed strings, not regexps
+	W           bool     // W flag - patterns match whole words only
+	X           bool     // X flag - patterns match whole lines only
+	S           bool     // S flag - smart case: ignore case in patterns without upper-case letters
+
 	L bool // L flag - print file names only
+	V bool // V flag - select non-matching lines
+
+	FilesWithoutMatch bool // L flag - print names of files without selected lines only
+
 	Z bool // 0 flag - print matches separated by \0
 	C bool // C flag - print count of matches
 	N bool // N flag - print line numbers
 	H bool // H flag - do not print file names
 
+	O           bool // o flag - print only the matched parts of lines
+	Column      bool // column flag - print the column of the first match
+	ShowPattern bool // showpattern flag - print the number of the first pattern matching each line
+
+	JSON bool // json flag - print results as JSON Lines
+
+	Output func(m *Match) // if set, receives the matching and context lines instead of them being printed
+
+	Color string // color flag - highlight output: ColorAuto, ColorAlways or ColorNever (default)
+
+	A       int // A flag - print lines of context after matches
+	B       int // B flag - print lines of context before matches
+	Context int // C flag - print lines of context around matches, unless overridden by A or B
+
 	Done                 bool
 	lines_printed        int64 // running match count
 	max_print_lines      int64 // Max match count
@@ -370,14 +420,178 @@ type Grep struct {
 	Match bool
 
 	buf []byte
+
+	name     string        // name of the current file
+	before   []contextLine // unprinted lines preceding the current position
+	after    int           // lines of after context left to print
+	lastLine int           // number of the last line printed from the current file
+	grouped  bool          // some lines have been printed with context
+
+	colorSet bool    // colors has been set from Color
+	colors   *colors // colors to print with, or nil
+
+	out bytes.Buffer // output line being built
+}
+
+// A contextLine is a line kept for printing as before context.
+type contextLine struct {
+	lineno int
+	offset int64
+	text   []byte
 }
 
 func (g *Grep) AddFlags() {
+	flag.Var((*patternList)(&g.E), "e", "search for this pattern (may be repeated)")
+	flag.StringVar(&g.PatternFile, "patterns", "", "search for the patterns in this file, one per line")
+	flag.BoolVar(&g.F, "F", false, "search for fixed strings, not regexps")
+	flag.BoolVar(&g.W, "w", false, "match whole words only")
+	flag.BoolVar(&g.X, "x", false, "match whole lines only")
+	smartCase, _ := strconv.ParseBool(os.Getenv("CSEARCHSMARTCASE"))
+	flag.BoolVar(&g.S, "S", smartCase, "ignore case in patterns without upper-case letters (default $CSEARCHSMARTCASE)")
 	flag.BoolVar(&g.L, "l", false, "list matching files only")
+	flag.BoolVar(&g.FilesWithoutMatch, "L", false, "list files without matches only")
+	flag.BoolVar(&g.V, "v", false, "select non-matching lines")
 	flag.BoolVar(&g.Z, "0", false, "list filename matches separated by NUL ('\\0') character. Requires -l option")
 	flag.BoolVar(&g.C, "c", false, "print match counts only")
 	flag.BoolVar(&g.N, "n", false, "show line numbers")
 	flag.BoolVar(&g.H, "h", false, "omit file names")
+	flag.IntVar(&g.A, "A", 0, "print this many lines of context after matches")
+	flag.IntVar(&g.B, "B", 0, "print this many lines of context before matches")
+	flag.IntVar(&g.Context, "C", 0, "print this many lines of context around matches")
+	flag.BoolVar(&g.O, "o", false, "print only the matched parts of lines, one per line")
+	flag.BoolVar(&g.Column, "column", false, "print the column of the first match in each line")
+	flag.BoolVar(&g.ShowPattern, "showpattern", false, "print the number of the first pattern matching each line")
+	flag.BoolVar(&g.JSON, "json", false, "print results as JSON Lines")
+	g.Color = ColorAuto
+	flag.Var((*colorMode)(&g.Color), "color", "highlight output: auto, always or never")
+}
+
+// A patternList is a flag.Value collecting the values of a repeated flag.
+type patternList []string
+
+func (p *patternList) String() string { return strings.Join(*p, ", ") }
+
+func (p *patternList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// Exprs returns the patterns to search for, from the E and PatternFile
+// fields or, if both are empty, the first of the command-line
+// arguments args, along with the remaining arguments.
+func (g *Grep) Exprs(args []string) (exprs, rest []string, err error) {
+	if len(g.E) == 0 && g.PatternFile == "" {
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("no pattern to search for")
+		}
+		return args[:1], args[1:], nil
+	}
+	exprs = append(exprs, g.E...)
+	if g.PatternFile != "" {
+		data, err := ioutil.ReadFile(g.PatternFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) > 0 {
+			s := strings.TrimSuffix(string(data), "\n")
+			exprs = append(exprs, strings.Split(s, "\n")...)
+		}
+	}
+	return exprs, args, nil
+}
+
+// Compile returns a Regexp matching wherever any of the patterns exprs
+// matches, ignoring case if fold is set or, if S is set, for each
+// pattern without upper-case letters.  The patterns are taken as
+// fixed strings if F is set, and must match whole words if W is set
+// or whole lines if X is set.
+func (g *Grep) Compile(exprs []string, fold bool) (*Regexp, error) {
+	var subs []*Regexp
+	for _, expr := range exprs {
+		re := expr
+		if g.F {
+			re = stdregexp.QuoteMeta(expr)
+		}
+		fold := fold
+		if g.S && !fold {
+			fold = !hasUpper(re)
+		}
+		if g.F && !g.W && !g.X {
+			sub, err := CompileLiteral(expr, fold)
+			if err != nil {
+				return nil, err
+			}
+			subs = append(subs, sub)
+			continue
+		}
+		// The group keeps alternations in the pattern
+		// inside the boundaries, and flags set in it from
+		// applying to them.
+		switch {
+		case g.X:
+			re = `^(?:` + re + `)$`
+		case g.W:
+			re = `\b(?:` + re + `)\b`
+		}
+		pat := "(?m)" + re
+		if fold {
+			pat = "(?i)" + pat
+		}
+		sub, err := Compile(pat)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return compileAny(subs)
+}
+
+// hasUpper reports whether the literal text in the regexp expr has
+// upper-case letters, other than in parts already matched regardless
+// of case.  Character classes do not count, so that \S or \W does not.
+func hasUpper(expr string) bool {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return literalUpper(re)
+}
+
+func literalUpper(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0 {
+		for _, r := range re.Rune {
+			if unicode.IsUpper(r) {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if literalUpper(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// beforeLines returns the number of lines of context to print before matches.
+func (g *Grep) beforeLines() int {
+	if g.B > 0 {
+		return g.B
+	}
+	return g.Context
+}
+
+// afterLines returns the number of lines of context to print after matches.
+func (g *Grep) afterLines() int {
+	if g.A > 0 {
+		return g.A
+	}
+	return g.Context
+}
+
+// context reports whether lines of context are printed.
+func (g *Grep) context() bool {
+	return !g.L && !g.FilesWithoutMatch && !g.C && !g.O && (g.beforeLines() > 0 || g.afterLines() > 0)
 }
 
 func (g *Grep) File(name string) {
@@ -427,21 +641,58 @@ func (g *Grep) Reader(r io.Reader, name string) {
 	}
 	var (
 		buf                  = g.buf[:0]
-		needLineno           = g.N
+		context              = g.context()
+		needLineno           = g.N || g.JSON || g.Output != nil || context
 		lineno               = 1
+		offset               = int64(0) // offset of buf in the file
 		count                = 0
-		prefix               = ""
 		beginText            = true
 		endText              = false
 		outSep               = '\n'
 		printedForFile int64 = 0
+		stopping             = false // limit reached; printing trailing context
+		selected             = false // some line has been selected
 	)
-	if !g.H {
-		prefix = name + ":"
-	}
-	if g.L && g.Z {
+	if (g.L || g.FilesWithoutMatch) && g.Z {
 		outSep = '\x00'
 	}
+	g.name = name
+	g.before = g.before[:0]
+	g.after = 0
+	g.lastLine = 0
+
+	// selectLine handles a selected line, found at lineStart in buf,
+	// and reports whether the rest of the file can be skipped.
+	selectLine := func(line []byte, lineStart int) (skip bool) {
+		selected = true
+		if g.FilesWithoutMatch {
+			return true
+		}
+		g.Match = true
+		if g.L {
+			g.printName(name, outSep)
+			return true
+		}
+		if g.C {
+			count++
+			return false
+		}
+		g.printMatch(lineno, offset+int64(lineStart), line)
+		g.lines_printed++
+		printedForFile++
+		if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
+			g.Done = true
+		}
+		if g.Done {
+			// The limit is reached, or Output asked to stop.
+			stopping = true
+		}
+		if g.maxPrintLinesPerFile > 0 && printedForFile >= g.maxPrintLinesPerFile {
+			stopping = true
+		}
+		return false
+	}
+
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
@@ -452,64 +703,70 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			endText = true
 		}
 		chunkStart := 0
-		for chunkStart < end {
+		for chunkStart < end && !stopping {
 			m1 := g.Regexp.Match(buf[chunkStart:end], beginText, endText) + chunkStart
 			beginText = false
-			if m1 < chunkStart {
+			if m1 < chunkStart && !g.V {
 				break
 			}
-			g.Match = true
-			if g.L {
-				fmt.Fprintf(g.Stdout, "%s%c", name, outSep)
-				g.lines_printed++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
+			lineStart, lineEnd := end, end
+			if m1 >= chunkStart {
+				lineStart = bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
+				lineEnd = m1 + 1
+				if lineEnd > end {
+					lineEnd = end
 				}
-				return
-			}
-			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
-			lineEnd := m1 + 1
-			if lineEnd > end {
-				lineEnd = end
-			}
-			if needLineno {
-				lineno += countNL(buf[chunkStart:lineStart])
 			}
-			line := buf[lineStart:lineEnd]
-			switch {
-			case g.C:
-				count++
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s", prefix, lineno, line)
-				g.lines_printed++
-				printedForFile++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
-					return
+			if g.V {
+				// The lines before the match are selected,
+				// and the matching line is not.
+				for chunkStart < lineStart && !stopping {
+					i := bytes.IndexByte(buf[chunkStart:lineStart], '\n') + 1 + chunkStart
+					if i == chunkStart {
+						i = lineStart
+					}
+					if selectLine(buf[chunkStart:i], chunkStart) {
+						return
+					}
+					lineno++
+					chunkStart = i
 				}
-				if g.maxPrintLinesPerFile > 0 && printedForFile >= g.maxPrintLinesPerFile {
-					return
+				if stopping {
+					break
 				}
-			default:
-				fmt.Fprintf(g.Stdout, "%s%s", prefix, line)
-				g.lines_printed++
-				printedForFile++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
-					return
+				if context {
+					g.skipLines(buf[lineStart:lineEnd], lineno, offset+int64(lineStart))
 				}
-				if g.maxPrintLinesPerFile > 0 && printedForFile >= g.maxPrintLinesPerFile {
-					return
+				if lineEnd > lineStart {
+					lineno++
 				}
+				chunkStart = lineEnd
+				continue
+			}
+			if context {
+				g.skipLines(buf[chunkStart:lineStart], lineno, offset+int64(chunkStart))
+			}
+			if needLineno {
+				lineno += countNL(buf[chunkStart:lineStart])
+			}
+			if selectLine(buf[lineStart:lineEnd], lineStart) {
+				return
 			}
 			if needLineno {
 				lineno++
 			}
 			chunkStart = lineEnd
 		}
-		if needLineno && err == nil {
+		if context {
+			g.skipLines(buf[chunkStart:end], lineno, offset+int64(chunkStart))
+		}
+		if stopping && g.after == 0 {
+			return
+		}
+		if (needLineno || g.V) && err == nil {
 			lineno += countNL(buf[chunkStart:end])
 		}
+		offset += int64(end)
 		n = copy(buf, buf[end:])
 		buf = buf[:n]
 		if len(buf) == 0 && err != nil {
@@ -520,8 +777,21 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			break
 		}
 	}
+	if g.FilesWithoutMatch && !selected {
+		g.Match = true
+		g.printName(name, outSep)
+		return
+	}
 	if g.C && count > 0 {
-		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+		if g.JSON {
+			g.printJSON(&jsonCount{Type: "count", Path: jsonString(name), PathBase64: jsonBytes(name), Count: count})
+		} else if c := g.palette(); c != nil {
+			c.paint(g.Stdout, c.file, []byte(name))
+			c.paint(g.Stdout, c.sep, []byte{':'})
+			fmt.Fprintf(g.Stdout, " %d\n", count)
+		} else {
+			fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+		}
 		g.lines_printed++
 		if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
 			g.Done = true
@@ -529,3 +799,133 @@ func (g *Grep) Reader(r io.Reader, name string) {
 		}
 	}
 }
+
+// printName prints the name of a file for -l or -L,
+// followed by sep.
+func (g *Grep) printName(name string, sep rune) {
+	if g.JSON {
+		g.printJSON(&jsonFile{Type: "file", Path: jsonString(name), PathBase64: jsonBytes(name)})
+	} else if c := g.palette(); c != nil {
+		c.paint(g.Stdout, c.file, []byte(name))
+		fmt.Fprintf(g.Stdout, "%c", sep)
+	} else {
+		fmt.Fprintf(g.Stdout, "%s%c", name, sep)
+	}
+	g.lines_printed++
+	if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
+		g.Done = true
+	}
+}
+
+// printMatch prints the matching line with the given number and
+// offset in the file, preceded by its before context.
+func (g *Grep) printMatch(lineno int, offset int64, line []byte) {
+	for _, l := range g.before {
+		g.printLine(l.lineno, l.offset, '-', l.text)
+	}
+	g.before = g.before[:0]
+	g.printLine(lineno, offset, ':', line)
+	g.after = g.afterLines()
+}
+
+// skipLines handles the lines in b, which do not match and start
+// with line number lineno at the given offset in the file: it prints
+// those that are after context and keeps a copy of the last few as
+// before context.
+func (g *Grep) skipLines(b []byte, lineno int, offset int64) {
+	for g.after > 0 && len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		g.printLine(lineno, offset, '-', b[:i])
+		g.after--
+		lineno++
+		offset += int64(i)
+		b = b[i:]
+	}
+	nb := g.beforeLines()
+	if nb == 0 || len(b) == 0 {
+		return
+	}
+	// Only the last nb lines of b can be printed as before context.
+	n := countNL(b)
+	if b[len(b)-1] != '\n' {
+		n++
+	}
+	if n > nb {
+		i := len(b) - 1
+		for k := 0; k < nb; k++ {
+			i = bytes.LastIndexByte(b[:i], '\n')
+		}
+		offset += int64(i + 1)
+		b = b[i+1:]
+		lineno += n - nb
+		n = nb
+		g.before = g.before[:0]
+	}
+	if drop := len(g.before) + n - nb; drop > 0 {
+		g.before = append(g.before[:0], g.before[drop:]...)
+	}
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		g.before = append(g.before, contextLine{lineno, offset, append([]byte(nil), b[:i]...)})
+		lineno++
+		offset += int64(i)
+		b = b[i:]
+	}
+}
+
+// printSeparator prints the -- line separating groups of lines
+// printed with context.
+func (g *Grep) printSeparator() {
+	if c := g.palette(); c != nil {
+		c.paint(g.Stdout, c.sep, []byte("--"))
+		g.Stdout.Write(nl)
+	} else {
+		fmt.Fprintf(g.Stdout, "--\n")
+	}
+}
+
+// printLine prints a line with the given number and offset in the file,
+// marked by sep as a matching line (':') or a line of context ('-').
+// Before a line that does not follow the last one printed,
+// it prints a -- separator if context is being printed.
+func (g *Grep) printLine(lineno int, offset int64, sep byte, line []byte) {
+	if g.Output != nil {
+		g.outputLine(lineno, offset, sep, line)
+		return
+	}
+	if g.JSON {
+		g.printJSONLine(lineno, offset, sep, line)
+		return
+	}
+	c := g.palette()
+	if g.context() {
+		if g.grouped && (g.lastLine == 0 || lineno > g.lastLine+1) {
+			g.printSeparator()
+		}
+		g.grouped = true
+		g.lastLine = lineno
+	}
+	if c != nil || g.O || g.Column || g.ShowPattern {
+		if c == nil {
+			c = &noColors
+		}
+		g.printPainted(c, lineno, offset, sep, line)
+		return
+	}
+	switch {
+	case !g.H && g.N:
+		fmt.Fprintf(g.Stdout, "%s%c%d%c%s", g.name, sep, lineno, sep, line)
+	case !g.H:
+		fmt.Fprintf(g.Stdout, "%s%c%s", g.name, sep, line)
+	case g.N:
+		fmt.Fprintf(g.Stdout, "%d%c%s", lineno, sep, line)
+	default:
+		g.Stdout.Write(line)
+	}
+}
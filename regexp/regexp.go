@@ -8,7 +8,12 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	"bytes"
+	stdregexp "regexp"
+	"regexp/syntax"
+	"strings"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -20,6 +25,13 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+
+	spans bool    // rev and fwd are initialized
+	rev   matcher // reversed program, for finding match starts
+	fwd   matcher // anchored program, for finding match ends
+
+	subs []*Regexp // patterns combined by compileAny
+	lit  []byte    // string matched by a Regexp from CompileLiteral
 }
 
 // String returns the source text used to compile the regular expression.
@@ -39,7 +51,7 @@ func Compile(expr string) (*Regexp, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := toByteProg(prog); err != nil {
+	if err := toByteProg(prog, false); err != nil {
 		return nil, err
 	}
 	r := &Regexp{
@@ -52,10 +64,115 @@ func Compile(expr string) (*Regexp, error) {
 	return r, nil
 }
 
+// Copy returns a new Regexp matching the same text as r, for use
+// by another goroutine.
+func (r *Regexp) Copy() *Regexp {
+	r1 := &Regexp{
+		Syntax: r.Syntax,
+		expr:   r.expr,
+		lit:    r.lit,
+	}
+	r1.m.init(r.m.prog)
+	for _, sub := range r.subs {
+		r1.subs = append(r1.subs, sub.Copy())
+	}
+	return r1
+}
+
+// CompileLiteral returns a Regexp that matches the string lit,
+// ignoring case if fold is set.  Unless it ignores case, the Regexp
+// finds lit with a substring search rather than running a DFA.
+func CompileLiteral(lit string, fold bool) (*Regexp, error) {
+	expr := stdregexp.QuoteMeta(lit)
+	if fold {
+		expr = "(?i)" + expr
+	}
+	r, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if !fold && lit != "" && !strings.Contains(lit, "\n") {
+		r.lit = []byte(lit)
+	}
+	return r, nil
+}
+
+// Literal returns the string r matches and true if r is from
+// CompileLiteral and finds it by substring search.
+func (r *Regexp) Literal() (string, bool) {
+	return string(r.lit), r.lit != nil
+}
+
+// compileAny returns a Regexp matching wherever any of subs matches.
+func compileAny(subs []*Regexp) (*Regexp, error) {
+	if len(subs) == 1 {
+		return subs[0], nil
+	}
+	if len(subs) == 0 {
+		// An empty class, matching nothing.
+		return Compile(`[^\x00-\x{10FFFF}]`)
+	}
+	var alts []string
+	for _, sub := range subs {
+		// Flags set in a group end with it.
+		alts = append(alts, "(?:"+sub.expr+")")
+	}
+	r, err := Compile(strings.Join(alts, "|"))
+	if err != nil {
+		return nil, err
+	}
+	r.subs = subs
+	return r, nil
+}
+
+// Patterns returns the Regexps for the expressions r was compiled
+// from: those passed to Grep.Compile, or else r itself.
+func (r *Regexp) Patterns() []*Regexp {
+	if r.subs == nil {
+		return []*Regexp{r}
+	}
+	return r.subs
+}
+
+// MatchPattern returns the index in Patterns of the first pattern
+// matching in b, or -1 if none does.
+func (r *Regexp) MatchPattern(b []byte, beginText, endText bool) int {
+	for i, sub := range r.Patterns() {
+		if sub.Match(b, beginText, endText) >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
 func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
+	if r.lit != nil {
+		i := bytes.Index(b, r.lit)
+		if i < 0 {
+			return -1
+		}
+		return lineEnd(bytes.IndexByte(b[i:], '\n'), i, len(b))
+	}
 	return r.m.match(b, beginText, endText)
 }
 
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
+	if r.lit != nil {
+		i := strings.Index(s, string(r.lit))
+		if i < 0 {
+			return -1
+		}
+		return lineEnd(strings.IndexByte(s[i:], '\n'), i, len(s))
+	}
 	return r.m.matchString(s, beginText, endText)
 }
+
+// lineEnd returns the end of the line containing a literal match at i,
+// given the offset j from i of the next newline, or -1 if there is none,
+// and the length n of the text.
+func lineEnd(j, i, n int) int {
+	if j < 0 {
+		return n
+	}
+	return i + j
+}
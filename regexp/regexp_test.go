@@ -8,9 +8,18 @@ package regexp
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	stdregexp "regexp"
 	"strings"
 	"testing"
+
+	"github.com/junkblocker/codesearch/index"
 )
 
 var nstateTests = []struct {
@@ -199,9 +208,71 @@ var grepTests = []struct {
 }{
 	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:abc\ninput:ghalloo\n"},
 	{re: `x.*y`, s: "xay\nxa\ny\n", out: "input:xay\n"},
+
+	// context
+	{re: `c`, s: lines, out: "input-2-b\ninput:3:c\ninput-4-d\n", g: Grep{N: true, Context: 1}},
+	{re: `[bf]`, s: lines, out: "input:b\ninput-c\n--\ninput:f\ninput-g\n", g: Grep{A: 1}},
+	{re: `[ce]`, s: lines, out: "2-b\n3:c\n4-d\n5:e\n6-f\n", g: Grep{H: true, N: true, Context: 1}},
+	{re: `[ag]`, s: lines, out: "a\nb\n--\ne\nf\ng\n", g: Grep{H: true, A: 1, B: 2}},
+	{re: `a`, s: lines, out: "input:a\n", g: Grep{B: 2}},
+	{re: `[bd]`, s: lines, out: "b\nc\n", g: Grep{H: true, A: 1, max_print_lines: 1}},
+	{re: `x`, s: "x\ny", out: "x\ny", g: Grep{H: true, A: 1}},
+	{re: `x`, s: "x\ny", out: "input: 1\n", g: Grep{C: true, A: 1}},
+
+	// context across buffer boundaries
+	{re: `[ag]`, s: lines, out: "1:a\n2-b\n3-c\n--\n5-e\n6-f\n7:g\n", g: Grep{H: true, N: true, Context: 2, buf: make([]byte, 4)}},
+	{re: `[dg]`, s: lines, out: "a\nb\nc\nd\ne\nf\ng\n", g: Grep{H: true, B: 3, buf: make([]byte, 2)}},
+	{re: `b`, s: lines, out: "b\nc\nd\ne\n", g: Grep{H: true, A: 3, buf: make([]byte, 4)}},
+
+	// only matching, column
+	{re: `b+`, s: "abbcb\nx\nb\n", out: "input:bb\ninput:b\ninput:b\n", g: Grep{O: true}},
+	{re: `b+`, s: "abbcb\nx\nb\n", out: "1:2:bb\n1:5:b\n3:1:b\n", g: Grep{O: true, H: true, N: true, Column: true}},
+	{re: `x*`, s: "abc\nax\n", out: "input:x\n", g: Grep{O: true}},
+	{re: `[bd]`, s: lines, out: "input:b\ninput:d\n", g: Grep{O: true, Context: 1}},
+	{re: `c+`, s: "abcc\nd\ne", out: "input:1:3:abcc\ninput-2-d\n", g: Grep{N: true, Column: true, A: 1}},
+	{re: `b+`, s: "abbc\n", out: "\x1b[35m\x1b[Kinput\x1b[m\x1b[K\x1b[36m\x1b[K:\x1b[m\x1b[K\x1b[01;31m\x1b[Kbb\x1b[m\x1b[K\n", g: Grep{O: true, Color: ColorAlways}},
+
+	// invert, files without match
+	{re: `[bdf]`, s: lines, out: "input:a\ninput:c\ninput:e\ninput:g\n", g: Grep{V: true}},
+	{re: `[bdf]`, s: "a\nb\nc", out: "1:a\n3:c", g: Grep{V: true, H: true, N: true}},
+	{re: `[a-f]`, s: lines, out: "5-e\n6-f\n7:g\n", g: Grep{V: true, H: true, N: true, B: 2}},
+	{re: `[b-d]`, s: lines, out: "a\nb\n--\ne\nf\n", g: Grep{V: true, H: true, A: 1, maxPrintLinesPerFile: 2, buf: make([]byte, 2)}},
+	{re: `[^a-c]`, s: lines, out: "input: 3\n", g: Grep{V: true, C: true, buf: make([]byte, 4)}},
+	{re: `.`, s: lines, out: "", g: Grep{V: true}},
+	{re: `.`, s: "a\n\nb\n", out: "2:\n", g: Grep{V: true, H: true, N: true}},
+	{re: `x`, s: lines, out: "input\n", g: Grep{FilesWithoutMatch: true}},
+	{re: `c`, s: lines, out: "", g: Grep{FilesWithoutMatch: true}},
+	{re: `.`, s: lines, out: "input\n", g: Grep{FilesWithoutMatch: true, V: true}},
+	{re: `c`, s: lines, out: "input\n", g: Grep{L: true, V: true}},
+
+	// JSON
+	{re: `b+`, s: "abbc\nxyz\nb\n", out: `{"type":"match","path":"input","line":1,"offset":0,"matches":[{"start":1,"end":3}],"text":"abbc"}
+{"type":"match","path":"input","line":3,"offset":9,"matches":[{"start":0,"end":1}],"text":"b"}
+`, g: Grep{JSON: true}},
+	{re: `c`, s: lines, out: `{"type":"context","path":"input","line":2,"offset":2,"text":"b"}
+{"type":"match","path":"input","line":3,"offset":4,"matches":[{"start":0,"end":1}],"text":"c"}
+{"type":"context","path":"input","line":4,"offset":6,"text":"d"}
+`, g: Grep{JSON: true, Context: 1}},
+	{re: `a`, s: "a\xff\n", out: `{"type":"match","path":"input","line":1,"offset":0,"matches":[{"start":0,"end":1}],"text_base64":"Yf8="}
+`, g: Grep{JSON: true}},
+	{re: `[ab]`, s: lines, out: `{"type":"count","path":"input","count":2}
+`, g: Grep{JSON: true, C: true}},
+	{re: `[ab]`, s: lines, out: `{"type":"file","path":"input"}
+`, g: Grep{JSON: true, L: true}},
+
+	// color
+	{re: `b+`, s: "abbc\nx\n", out: "\x1b[35m\x1b[Kinput\x1b[m\x1b[K\x1b[36m\x1b[K:\x1b[m\x1b[Ka\x1b[01;31m\x1b[Kbb\x1b[m\x1b[Kc\n", g: Grep{Color: ColorAlways}},
+	{re: `b`, s: lines, out: "\x1b[32m\x1b[K2\x1b[m\x1b[K\x1b[36m\x1b[K:\x1b[m\x1b[K\x1b[01;31m\x1b[Kb\x1b[m\x1b[K\n\x1b[32m\x1b[K3\x1b[m\x1b[K\x1b[36m\x1b[K-\x1b[m\x1b[Kc\n", g: Grep{Color: ColorAlways, H: true, N: true, A: 1}},
+	{re: `b`, s: lines, out: "\x1b[35m\x1b[Kinput\x1b[m\x1b[K\n", g: Grep{Color: ColorAlways, L: true}},
+	{re: `b+`, s: "abbc\n", out: "input:abbc\n", g: Grep{Color: ColorAuto}},
+	{re: `b+`, s: "abbc\n", out: "input:abbc\n", g: Grep{Color: ColorNever}},
 }
 
+const lines = "a\nb\nc\nd\ne\nf\ng\n"
+
 func TestGrep(t *testing.T) {
+	defer os.Setenv("GREP_COLORS", os.Getenv("GREP_COLORS"))
+	os.Setenv("GREP_COLORS", "")
 	for i, tt := range grepTests {
 		re, err := Compile("(?m)" + tt.re)
 		if err != nil {
@@ -219,3 +290,408 @@ func TestGrep(t *testing.T) {
 		}
 	}
 }
+
+// compileAll compiles exprs into a single Regexp, as Grep.Compile does.
+func compileAll(t *testing.T, exprs ...string) *Regexp {
+	var subs []*Regexp
+	for _, expr := range exprs {
+		sub, err := Compile(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	re, err := compileAny(subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
+
+func TestCompileAny(t *testing.T) {
+	re := compileAll(t, `(?m)^b`, `(?i)(?m)C$`, `(?m)b|d`)
+	for i, tt := range []struct {
+		s       string
+		pattern int
+	}{
+		{"b", 0}, {"abx", 2}, {"c", 1}, {"x", -1},
+	} {
+		if p := re.MatchPattern([]byte(tt.s), true, true); p != tt.pattern {
+			t.Errorf("#%d: MatchPattern(%q) = %d, want %d", i, tt.s, p, tt.pattern)
+		}
+	}
+
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, N: true, ShowPattern: true}
+	g.Reader(strings.NewReader("abx\nb\ncd\ne\n"), "input")
+	if want := "input:1:3:abx\ninput:2:1:b\ninput:3:3:cd\n"; out.String() != want {
+		t.Errorf("grep -showpattern = %q, want %q", out.String(), want)
+	}
+
+	if re := compileAll(t); re.Match([]byte("x\n"), true, true) >= 0 {
+		t.Errorf("compileAny(nil) matches")
+	}
+}
+
+var literalTests = []string{
+	"foo.bar(\nx\n",
+	"a[i]\nfoo.bar(",
+	"xfoo.bar(y",
+	"foo.bar",
+	"",
+}
+
+func TestCompileLiteral(t *testing.T) {
+	for _, lit := range []string{"foo.bar(", "a[i]", "x\ny"} {
+		re, err := CompileLiteral(lit, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dfa, err := Compile(stdregexp.QuoteMeta(lit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range literalTests {
+			m, want := re.Match([]byte(s), true, true), dfa.Match([]byte(s), true, true)
+			if m != want {
+				t.Errorf("CompileLiteral(%q).Match(%q) = %d, want %d", lit, s, m, want)
+			}
+			m, want = re.MatchString(s, true, true), dfa.MatchString(s, true, true)
+			if m != want {
+				t.Errorf("CompileLiteral(%q).MatchString(%q) = %d, want %d", lit, s, m, want)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	g := Grep{Stdout: &out, F: true, H: true, O: true}
+	re, err := g.Compile([]string{"A[", "b.c"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Regexp = re
+	g.Reader(strings.NewReader("xa[y\nbxc\nB.C\n"), "input")
+	if want := "a[\nB.C\n"; out.String() != want {
+		t.Errorf("grep -F -i -o = %q, want %q", out.String(), want)
+	}
+}
+
+var grepCompileTests = []struct {
+	exprs []string
+	fold  bool
+	s     string
+	out   string
+	g     Grep
+}{
+	{[]string{`foo|bar`}, false, "foo\nfood\nbar.\nxbar\n", "foo\nbar.\n", Grep{W: true}},
+	{[]string{`foo|bar`}, false, "foo\nfood\nbar\nxbar\n", "foo\nbar\n", Grep{X: true}},
+	{[]string{`a.c`, `d`}, false, "abc\na.c\nd\nx d\n", "a.c\nd\n", Grep{F: true, X: true}},
+	{[]string{`a.c`}, true, "A.C d\nxa.c\n", "A.C d\n", Grep{F: true, W: true}},
+	{[]string{`(?i)ab`, `c`}, false, "AB\nC\nc\n", "AB\nc\n", Grep{X: true}},
+
+	// smart case
+	{[]string{`foo\S`}, false, "FOOD\nfoo \n", "FOOD\n", Grep{S: true}},
+	{[]string{`Foo`}, false, "FOO\nFoo\n", "Foo\n", Grep{S: true}},
+	{[]string{`Foo`, `bar`}, false, "FOO\nBAR\n", "BAR\n", Grep{S: true}},
+	{[]string{`Foo`}, true, "FOO\n", "FOO\n", Grep{S: true}},
+	{[]string{`a.b`}, false, "A.B\nAxB\n", "A.B\n", Grep{S: true, F: true}},
+	{[]string{`A.b`}, false, "A.B\nA.b\n", "A.b\n", Grep{S: true, F: true}},
+}
+
+var hasUpperTests = []struct {
+	expr  string
+	upper bool
+}{
+	{`foo`, false},
+	{`fOo`, true},
+	{`\S+\W\D`, false},
+	{`[A-Z]x`, false},
+	{`(?i)Foo`, false},
+	{`(?i:Foo)Bar`, true},
+	{`\x41`, true},
+	{`école|Été`, true},
+	{`(`, false},
+}
+
+func TestHasUpper(t *testing.T) {
+	for _, tt := range hasUpperTests {
+		if upper := hasUpper(tt.expr); upper != tt.upper {
+			t.Errorf("hasUpper(%#q) = %v, want %v", tt.expr, upper, tt.upper)
+		}
+	}
+}
+
+func TestGrepCompile(t *testing.T) {
+	for i, tt := range grepCompileTests {
+		g := tt.g
+		re, err := g.Compile(tt.exprs, tt.fold)
+		if err != nil {
+			t.Errorf("#%d: Compile(%#q): %v", i, tt.exprs, err)
+			continue
+		}
+		var out bytes.Buffer
+		g.Regexp = re
+		g.Stdout = &out
+		g.H = true
+		g.Reader(strings.NewReader(tt.s), "input")
+		if out.String() != tt.out {
+			t.Errorf("#%d: grep(%#q, %q) = %q, want %q", i, tt.exprs, tt.s, out.String(), tt.out)
+		}
+	}
+}
+
+var parseColorsTests = []struct {
+	s string
+	c colors
+}{
+	{"", defaultColors},
+	{"ms=01;32:fn=:ne", colors{match: "01;32", line: "32", sep: "36", noErase: true}},
+	{"mt=4:sl=1:cx=2:ln=33:se=34:bn=35:rv", colors{match: "4", selected: "1", context: "2", file: "35", line: "33", sep: "34"}},
+}
+
+func TestParseColors(t *testing.T) {
+	for _, tt := range parseColorsTests {
+		if c := parseColors(tt.s); *c != tt.c {
+			t.Errorf("parseColors(%q) = %+v, want %+v", tt.s, *c, tt.c)
+		}
+	}
+}
+
+var lineMatchesREs = []string{
+	`a+`,
+	`ab|abcd`,
+	`(a|ab)(c|bcd)`,
+	`b*`,
+	`x*`,
+	`\bfoo\b`,
+	`\Bo`,
+	`^a`,
+	`c$`,
+	`^`,
+	`$`,
+	`a.c`,
+	`.`,
+	`[α-ω]+`,
+	`(?i)straße`,
+	`é+`,
+	`日本`,
+	`\pL+`,
+	`[^a]+`,
+}
+
+var lineMatchesLines = []string{
+	"",
+	"foo food foo",
+	"aaa baaa",
+	"abcd abcdx ab",
+	"abc",
+	"αβγ abc ωx",
+	"Straße STRASSE strasse",
+	"éé e é",
+	"日本語 日本",
+	"xyz",
+	"bb",
+}
+
+func TestLineMatches(t *testing.T) {
+	for _, expr := range lineMatchesREs {
+		re, err := Compile("(?m)" + expr)
+		if err != nil {
+			t.Errorf("Compile(%#q): %v", expr, err)
+			continue
+		}
+		std := stdregexp.MustCompile("(?m)" + expr)
+		std.Longest()
+		for _, line := range lineMatchesLines {
+			var want [][2]int
+			for _, m := range std.FindAllStringIndex(line, -1) {
+				want = append(want, [2]int{m[0], m[1]})
+			}
+			have := re.LineMatches([]byte(line), true, true)
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("LineMatches(%#q, %q) = %v, want %v", expr, line, have, want)
+			}
+		}
+	}
+}
+
+func TestLineMatchesText(t *testing.T) {
+	// \A and \z match only where the line begins or ends the text.
+	re, err := Compile(`(?m)\Aa|b\z`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte("ab")
+	for _, tt := range []struct {
+		beginText, endText bool
+		want               [][2]int
+	}{
+		{false, false, nil},
+		{true, false, [][2]int{{0, 1}}},
+		{false, true, [][2]int{{1, 2}}},
+		{true, true, [][2]int{{0, 1}, {1, 2}}},
+	} {
+		if have := re.LineMatches(line, tt.beginText, tt.endText); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("LineMatches(%q, %v, %v) = %v, want %v", line, tt.beginText, tt.endText, have, tt.want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grep-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("f%02d", i))
+		s := strings.Repeat(lines, i%4)
+		if err := ioutil.WriteFile(name, []byte(s), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, filepath.Join(dir, "missing"))
+
+	re, err := Compile(`(?m)[bf]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range []Grep{
+		{N: true},
+		{C: true},
+		{L: true},
+		{FilesWithoutMatch: true},
+		{N: true, A: 1},
+		{B: 2, max_print_lines: 7},
+		{max_print_lines: 10},
+		{max_print_lines: 10, maxPrintLinesPerFile: 1},
+		{L: true, max_print_lines: 3},
+	} {
+		var want, out, wantErr, errs bytes.Buffer
+		g.Regexp = re
+		g1 := g
+		g1.Stdout, g1.Stderr = &want, &wantErr
+		g1.Files(names, 1)
+		g.Stdout, g.Stderr = &out, &errs
+		g.Files(names, 4)
+		if out.String() != want.String() || errs.String() != wantErr.String() {
+			t.Errorf("#%d: Files with 4 workers printed\n%s%s\nwant\n%s%s", i, out.String(), errs.String(), want.String(), wantErr.String())
+		}
+		if g.Match != g1.Match || g.lines_printed != g1.lines_printed {
+			t.Errorf("#%d: Files with 4 workers: Match, printed = %v, %d, want %v, %d", i, g.Match, g.lines_printed, g1.Match, g1.lines_printed)
+		}
+	}
+}
+
+var indexQueryTests = []struct {
+	exprs []string
+	fixed bool
+	q     string
+}{
+	{[]string{`abcd`, `wxyz`}, false, `("abc" "bcd")|("wxy" "xyz")`},
+	{[]string{`abc`, `abc.*def`}, false, `"abc"`},
+	{[]string{`abc`, `.`}, false, `+`},
+	{[]string{`a.cd`}, true, `".cd" "a.c"`},
+	{[]string{`a.cd`, `xy`}, true, `+`},
+}
+
+func TestIndexQuery(t *testing.T) {
+	for _, tt := range indexQueryTests {
+		g := &Grep{F: tt.fixed}
+		re, err := g.Compile(tt.exprs, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := re.IndexQuery().String(); q != tt.q {
+			t.Errorf("IndexQuery(%#q, F=%v) = %#q, want %#q", tt.exprs, tt.fixed, q, tt.q)
+		}
+	}
+}
+
+func TestSearcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.go":  "package a\n\nfunc alpha() {}\n",
+		"b.go":  "package b\n\nfunc beta() {}\nfunc gamma() {}\n",
+		"c.txt": "nothing to see\n",
+	}
+	ixFile := filepath.Join(dir, "index")
+	w := index.Create(ixFile)
+	w.AddPaths([]string{dir})
+	for _, name := range []string{"a.go", "b.go", "c.txt"} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(files[filepath.Base(name)]), 0666); err != nil {
+			t.Fatal(err)
+		}
+		w.AddFile(name)
+	}
+	w.Flush()
+	ix, err := index.OpenIndex(ixFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	re, err := Compile(`(?m)func \w+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(s *Searcher, ctx context.Context) (string, error) {
+		var out bytes.Buffer
+		err := s.Search(ctx, func(m *Match) error {
+			fmt.Fprintf(&out, "%s:%d:%d:%v:%v:%s\n", filepath.Base(m.Path), m.Line, m.Offset, m.Context, m.Spans, m.Text)
+			return nil
+		})
+		return out.String(), err
+	}
+
+	out, err := search(&Searcher{Index: ix, Regexp: re, Context: 1}, context.Background())
+	want := "a.go:2:10:true:[]:\n" +
+		"a.go:3:11:false:[[0 10]]:func alpha() {}\n" +
+		"b.go:2:10:true:[]:\n" +
+		"b.go:3:11:false:[[0 9]]:func beta() {}\n" +
+		"b.go:4:26:false:[[0 10]]:func gamma() {}\n"
+	if err != nil || out != want {
+		t.Errorf("Search = %q, %v, want %q", out, err, want)
+	}
+
+	nameRE, _ := Compile(`b\.go$`)
+	out, err = search(&Searcher{Index: ix, Regexp: re, Name: nameRE, MaxMatches: 1}, context.Background())
+	want = "b.go:3:11:false:[[0 9]]:func beta() {}\n"
+	if err != nil || out != want {
+		t.Errorf("Search with Name and MaxMatches = %q, %v, want %q", out, err, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if out, err = search(&Searcher{Index: ix, Regexp: re}, ctx); err != context.Canceled || out != "" {
+		t.Errorf("Search with canceled context = %q, %v, want \"\", %v", out, err, context.Canceled)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = (&Searcher{Index: ix, Regexp: re}).Search(context.Background(), func(m *Match) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Search stopped by fn: %v after %d lines, want %v after 1", err, n, stop)
+	}
+
+	os.Remove(filepath.Join(dir, "a.go"))
+	var failed []string
+	s := &Searcher{Index: ix, Regexp: re, FileError: func(name string, err error) error {
+		failed = append(failed, filepath.Base(name))
+		return nil
+	}}
+	out, err = search(s, context.Background())
+	if err != nil || strings.Contains(out, "a.go") || !reflect.DeepEqual(failed, []string{"a.go"}) {
+		t.Errorf("Search with missing file = %q, %v, failed %v", out, err, failed)
+	}
+}
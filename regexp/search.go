@@ -0,0 +1,182 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/junkblocker/codesearch/index"
+)
+
+// A Match is a line found by a search: a selected line, with the
+// positions of the matches in it, or a line of context.
+type Match struct {
+	Path    string   // name of the file
+	Line    int      // line number, counting from 1
+	Offset  int64    // byte offset of the line in the file
+	Text    []byte   // the line, without its terminating newline
+	Spans   [][2]int // start and end offsets of the matches in Text
+	Pattern int      // with Grep.ShowPattern, number of the first matching pattern, counting from 1
+	Context bool     // the line is context, not a selected line
+}
+
+// match returns the Match for a line with the given number and offset
+// in the file, selected if sep is ':' or else context.  Its Text is
+// line without the newline, not a copy of it.
+func (g *Grep) match(lineno int, offset int64, sep byte, line []byte) *Match {
+	eol := bytes.HasSuffix(line, nl)
+	line = bytes.TrimSuffix(line, nl)
+	m := &Match{
+		Path:    g.name,
+		Line:    lineno,
+		Offset:  offset,
+		Text:    line,
+		Context: sep != ':',
+	}
+	if !m.Context {
+		m.Spans = g.Regexp.LineMatches(line, offset == 0, !eol)
+		if g.ShowPattern {
+			m.Pattern = g.Regexp.MatchPattern(line, offset == 0, !eol) + 1
+		}
+	}
+	return m
+}
+
+// outputLine is printLine for Grep.Output.
+func (g *Grep) outputLine(lineno int, offset int64, sep byte, line []byte) {
+	m := g.match(lineno, offset, sep, line)
+	m.Text = append([]byte(nil), m.Text...)
+	g.Output(m)
+}
+
+// IndexQuery returns the query for the files in an index that may
+// match r: the files that may match any of its Patterns.
+func (r *Regexp) IndexQuery() *index.Query {
+	var q *index.Query
+	for _, p := range r.Patterns() {
+		pq := index.RegexpQuery(p.Syntax)
+		if lit, ok := p.Literal(); ok {
+			pq = index.LiteralQuery(lit)
+		}
+		if q == nil {
+			q = pq
+		} else {
+			q = q.Or(pq)
+		}
+	}
+	return q
+}
+
+// A Searcher searches the files in an index for a regexp, as csearch
+// does, passing the lines found to a function instead of printing them.
+// Unlike the commands, it never exits the program: it returns errors,
+// including the corruption of an index opened with index.OpenIndex.
+type Searcher struct {
+	Index      *index.Index
+	Regexp     *Regexp
+	Name       *Regexp // if not nil, only files with names matching Name are searched
+	Context    int     // lines of context to report around selected lines
+	MaxMatches int     // if > 0, stop after this many selected lines
+
+	// FileError, if not nil, is called for the files that cannot
+	// be read, and the search stops if it returns an error.
+	// Otherwise such files are skipped.
+	FileError func(name string, err error) error
+
+	// Searched is set by Search to the number of files it searched.
+	Searched int
+}
+
+// Search calls fn for each line found, in the order of the files in
+// the index.  It stops when ctx is done, returning ctx.Err(), or when
+// fn returns an error, returning that error.  If the index turns out
+// to be corrupt, it stops and returns the index's Err.
+func (s *Searcher) Search(ctx context.Context, fn func(m *Match) error) error {
+	post := s.Index.PostingQuery(s.Regexp.IndexQuery())
+	s.Searched = 0
+	if err := s.Index.Err(); err != nil {
+		return err
+	}
+
+	var outErr error // error stopping the search, from ctx or fn
+	g := &Grep{
+		Regexp:  s.Regexp,
+		Stdout:  ioutil.Discard,
+		Stderr:  ioutil.Discard,
+		Context: s.Context,
+	}
+	g.Output = func(m *Match) {
+		if outErr == nil {
+			outErr = ctx.Err()
+		}
+		if outErr == nil {
+			outErr = fn(m)
+		}
+		if outErr != nil {
+			g.Done = true
+		}
+	}
+	g.LimitPrintCount(int64(s.MaxMatches), 0)
+	for _, fileid := range post {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := s.Index.Name(fileid)
+		if err := s.Index.Err(); err != nil {
+			return err
+		}
+		if s.Name != nil && s.Name.MatchString(name, true, true) < 0 {
+			continue
+		}
+		s.Searched++
+		r := &searchReader{ctx: ctx}
+		f, err := os.Open(name)
+		if err == nil {
+			r.r = f
+			g.Reader(r, name)
+			f.Close()
+			err = r.err
+		}
+		if outErr != nil {
+			return outErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil && s.FileError != nil {
+			if err := s.FileError(name, err); err != nil {
+				return err
+			}
+		}
+		if g.Done {
+			break
+		}
+	}
+	return nil
+}
+
+// A searchReader reads a file for Searcher.Search, stopping early
+// when the context is done, and recording any read error.
+type searchReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
+
+func (r *searchReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,195 @@
+// Copyright 2013-2016 Manpreet Singh ( junkblocker@yahoo.com ). All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// Locating matches.
+//
+// The matcher used by Match only finds the lines containing a match:
+// once a match is seen, it skips to the end of the line.  To find where
+// the matches in such a line start and end, LineMatches runs two more
+// DFAs over the line.  The first runs a reversed copy of the program
+// backward from the end of the line, looking for matches starting
+// anywhere, and so marks every position where some match starts.
+// The second runs the program forward from each such start, anchored
+// there, and keeps going after a match to find the longest one.
+
+// compileSpans prepares the matchers used by LineMatches.
+func (r *Regexp) compileSpans() error {
+	rev := reverse(r.Syntax).Simplify()
+	prog, err := syntax.Compile(rev)
+	if err != nil {
+		return err
+	}
+	if err := toByteProg(prog, true); err != nil {
+		return err
+	}
+	r.rev.longest = true
+	if err := r.rev.init(prog); err != nil {
+		return err
+	}
+	r.fwd.anchored = true
+	r.fwd.longest = true
+	if err := r.fwd.init(r.m.prog); err != nil {
+		return err
+	}
+	r.spans = true
+	return nil
+}
+
+// LineMatches returns the start and end offsets of the successive
+// non-overlapping matches of r in line, a single line of text without
+// its terminating newline.  Among the matches starting at the same
+// position, it picks the longest, rather than the first one that the
+// order of the alternatives in the expression would prefer.
+// The flags beginText and endText report whether line begins and ends
+// the text, as in Match.
+func (r *Regexp) LineMatches(line []byte, beginText, endText bool) [][2]int {
+	if !r.spans {
+		if err := r.compileSpans(); err != nil {
+			return nil
+		}
+	}
+
+	// Mark the positions where matches start.
+	starts := make([]bool, len(line)+1)
+	d := r.rev.startLine
+	if endText {
+		d = r.rev.start
+	}
+	for i := len(line) - 1; i >= 0; i-- {
+		d = r.rev.step(d, int(line[i]))
+		if d.match {
+			starts[i+1] = true
+		}
+	}
+	if r.rev.computeNext(d, boundary(beginText)).match {
+		starts[0] = true
+	}
+
+	// Find the longest match from each start, skipping those
+	// that overlap a match already found.
+	var spans [][2]int
+	pos := 0
+	for s := 0; s <= len(line); s++ {
+		if !starts[s] || s < pos {
+			continue
+		}
+		e := r.fwd.longestMatch(line, s, beginText, endText)
+		if e < 0 {
+			continue
+		}
+		if e == s {
+			// No empty match right after another match,
+			// or inside a UTF-8 sequence.
+			if len(spans) > 0 && spans[len(spans)-1][1] == s || s < len(line) && !utf8.RuneStart(line[s]) {
+				continue
+			}
+		}
+		spans = append(spans, [2]int{s, e})
+		pos = e
+	}
+	return spans
+}
+
+// step returns the state after d reads the byte c.
+func (m *matcher) step(d *dstate, c int) *dstate {
+	d1 := d.next[c]
+	if d1 == nil {
+		d1 = m.computeNext(d, c)
+		d.next[c] = d1
+	}
+	return d1
+}
+
+// longestMatch returns the end of the longest match in line starting
+// at s, or -1 if there is none.  The matcher must be anchored and longest.
+func (m *matcher) longestMatch(line []byte, s int, beginText, endText bool) int {
+	var flag flags
+	if s == 0 {
+		flag |= flagBOL
+		if beginText {
+			flag |= flagBOT
+		}
+	} else if isWordByte(int(line[s-1])) {
+		flag |= flagWord
+	}
+	d := m.startFlag[flag]
+	if d == nil {
+		var op syntax.EmptyOp
+		if flag&flagBOL != 0 {
+			op |= syntax.EmptyBeginLine
+		}
+		if flag&flagBOT != 0 {
+			op |= syntax.EmptyBeginText
+		}
+		m.z1.q.Reset()
+		m.addq(&m.z1.q, uint32(m.prog.Start), op)
+		m.z1.flag = flag
+		d = m.cache(&m.z1)
+		if m.startFlag == nil {
+			m.startFlag = make(map[flags]*dstate)
+		}
+		m.startFlag[flag] = d
+	}
+	end := -1
+	for i := s; i < len(line); i++ {
+		d = m.step(d, int(line[i]))
+		if d.match {
+			end = i
+		}
+		if d.dead {
+			return end
+		}
+	}
+	if m.computeNext(d, boundary(endText)).match {
+		end = len(line)
+	}
+	return end
+}
+
+// boundary returns what a matcher reads past either end of a line:
+// endText if the line also ends the text, or else a newline.
+func boundary(atText bool) int {
+	if atText {
+		return endText
+	}
+	return '\n'
+}
+
+// reverse returns a copy of re matching the reversed text.
+func reverse(re *syntax.Regexp) *syntax.Regexp {
+	r := *re
+	switch re.Op {
+	case syntax.OpLiteral:
+		r.Rune = make([]rune, len(re.Rune))
+		for i, c := range re.Rune {
+			r.Rune[len(re.Rune)-1-i] = c
+		}
+	case syntax.OpBeginLine:
+		r.Op = syntax.OpEndLine
+	case syntax.OpEndLine:
+		r.Op = syntax.OpBeginLine
+	case syntax.OpBeginText:
+		r.Op = syntax.OpEndText
+	case syntax.OpEndText:
+		r.Op = syntax.OpBeginText
+	}
+	if len(re.Sub) > 0 {
+		r.Sub = make([]*syntax.Regexp, len(re.Sub))
+		for i, sub := range re.Sub {
+			if re.Op == syntax.OpConcat {
+				i = len(re.Sub) - 1 - i
+			}
+			r.Sub[i] = reverse(sub)
+		}
+	}
+	return &r
+}
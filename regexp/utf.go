@@ -20,8 +20,12 @@ const (
 	argFold = 1 << 16
 )
 
-func toByteProg(prog *syntax.Prog) error {
-	var b runeBuilder
+// toByteProg rewrites the rune instructions in prog into instructions
+// matching the bytes of their UTF-8 encodings.  If reverse is set,
+// prog is meant to run over reversed text, so the bytes of each
+// encoding are matched last to first.
+func toByteProg(prog *syntax.Prog, reverse bool) error {
+	b := runeBuilder{reverse: reverse}
 	for pc := range prog.Inst {
 		i := &prog.Inst[pc]
 		switch i.Op {
@@ -140,10 +144,11 @@ type cacheKey struct {
 }
 
 type runeBuilder struct {
-	begin uint32
-	out   uint32
-	cache map[cacheKey]uint32
-	p     *syntax.Prog
+	begin   uint32
+	out     uint32
+	cache   map[cacheKey]uint32
+	p       *syntax.Prog
+	reverse bool // match UTF-8 sequences last byte first
 }
 
 func (b *runeBuilder) init(p *syntax.Prog, begin, out uint32) {
@@ -263,8 +268,14 @@ func (b *runeBuilder) addRange(lo, hi rune, fold bool) {
 	}
 
 	pc := uint32(0)
-	for i := n - 1; i >= 0; i-- {
-		pc = b.suffix(ulo[i], uhi[i], false, pc)
+	if b.reverse {
+		for i := 0; i < n; i++ {
+			pc = b.suffix(ulo[i], uhi[i], false, pc)
+		}
+	} else {
+		for i := n - 1; i >= 0; i-- {
+			pc = b.suffix(ulo[i], uhi[i], false, pc)
+		}
 	}
 	b.addBranch(pc)
 }